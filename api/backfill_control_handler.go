@@ -0,0 +1,100 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/uber/aresdb/memstore"
+)
+
+// BackfillControlHandler exposes an imperative pause/resume/cancel control
+// surface for in-flight backfill jobs, on top of the read-only progress
+// already available through job details.
+type BackfillControlHandler struct {
+	scheduler memstore.Scheduler
+}
+
+// NewBackfillControlHandler creates a new BackfillControlHandler.
+func NewBackfillControlHandler(scheduler memstore.Scheduler) BackfillControlHandler {
+	return BackfillControlHandler{scheduler: scheduler}
+}
+
+// Register adds the backfill control routes to the given router.
+func (handler BackfillControlHandler) Register(router *mux.Router) {
+	router.HandleFunc("/tables/{table}/shards/{shard}/pause", handler.PauseJob).Methods(http.MethodPost)
+	router.HandleFunc("/tables/{table}/shards/{shard}/resume", handler.ResumeJob).Methods(http.MethodPost)
+	router.HandleFunc("/tables/{table}/shards/{shard}/cancel", handler.CancelJob).Methods(http.MethodPost)
+}
+
+func (handler BackfillControlHandler) jobKey(r *http.Request) (string, int, error) {
+	vars := mux.Vars(r)
+	shard, err := strconv.Atoi(vars["shard"])
+	if err != nil {
+		return "", 0, err
+	}
+	return vars["table"], shard, nil
+}
+
+// PauseJob swagger:route POST /backfill/tables/{table}/shards/{shard}/pause pauseBackfillJob
+// cooperatively pauses the in-flight backfill job for the given table and
+// shard.
+func (handler BackfillControlHandler) PauseJob(w http.ResponseWriter, r *http.Request) {
+	table, shard, err := handler.jobKey(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := handler.scheduler.PauseBackfillJob(table, shard); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondWithJSONObject(w, nil)
+}
+
+// ResumeJob swagger:route POST /backfill/tables/{table}/shards/{shard}/resume resumeBackfillJob
+// resumes a previously paused backfill job for the given table and shard.
+func (handler BackfillControlHandler) ResumeJob(w http.ResponseWriter, r *http.Request) {
+	table, shard, err := handler.jobKey(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := handler.scheduler.ResumeBackfillJob(table, shard); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondWithJSONObject(w, nil)
+}
+
+// CancelJob swagger:route POST /backfill/tables/{table}/shards/{shard}/cancel cancelBackfillJob
+// cancels the in-flight backfill job for the given table and shard,
+// discarding its in-progress ArchiveBatch without rolling back already
+// archived data.
+func (handler BackfillControlHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	table, shard, err := handler.jobKey(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := handler.scheduler.CancelBackfillJob(table, shard); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondWithJSONObject(w, nil)
+}
@@ -0,0 +1,45 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/uber/aresdb/memstore"
+)
+
+// ClusterHandler exposes the scheduler's leader election state so operators
+// can tell which node is currently acting as scheduler versus worker.
+type ClusterHandler struct {
+	scheduler memstore.Scheduler
+}
+
+// NewClusterHandler creates a new ClusterHandler.
+func NewClusterHandler(scheduler memstore.Scheduler) ClusterHandler {
+	return ClusterHandler{scheduler: scheduler}
+}
+
+// Register adds the cluster routes to the given router.
+func (handler ClusterHandler) Register(router *mux.Router) {
+	router.HandleFunc("", handler.GetClusterStatus).Methods(http.MethodGet)
+}
+
+// GetClusterStatus swagger:route GET /cluster getClusterStatus
+// reports this node's leader election state and scheduler/worker role.
+func (handler ClusterHandler) GetClusterStatus(w http.ResponseWriter, r *http.Request) {
+	RespondWithJSONObject(w, handler.scheduler.ClusterStatus())
+}
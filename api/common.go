@@ -0,0 +1,46 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// ErrColumnDoesNotExist is returned when a requested column has no enum
+// dictionary, either because the column itself or its enum dict is
+// missing from the table schema.
+var ErrColumnDoesNotExist = errors.New("column does not exist")
+
+// ErrEnumBatchTooLarge is returned when a resolve/lookup request's case
+// list exceeds the batch size the enum handler is willing to process in
+// one call.
+var ErrEnumBatchTooLarge = errors.New("enum batch request too large")
+
+// RespondWithError writes err as a JSON error body with the given status
+// code.
+func RespondWithError(w http.ResponseWriter, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// RespondWithJSONObject writes obj as a 200 OK JSON response body.
+func RespondWithJSONObject(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(obj)
+}
@@ -0,0 +1,193 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+	metaCom "github.com/uber/aresdb/metastore/common"
+)
+
+// maxEnumBatchSize bounds the number of enum cases accepted in a single
+// resolve/lookup request so a malformed or adversarial payload cannot blow
+// up memory while we build the response.
+const maxEnumBatchSize = 10000
+
+// EnumHandler serves read and mutate endpoints for a table column's enum
+// dictionary.
+type EnumHandler struct {
+	memStore  memCom.MemStore
+	metaStore metaCom.MetaStore
+}
+
+// NewEnumHandler creates a new EnumHandler.
+func NewEnumHandler(memStore memCom.MemStore, metaStore metaCom.MetaStore) EnumHandler {
+	return EnumHandler{
+		memStore:  memStore,
+		metaStore: metaStore,
+	}
+}
+
+// Register adds the enum routes to the given router.
+func (handler EnumHandler) Register(router *mux.Router) {
+	router.HandleFunc("/tables/{table}/columns/{column}/enum-cases", handler.ListEnumCases).Methods(http.MethodGet)
+	router.HandleFunc("/tables/{table}/columns/{column}/enum-cases", handler.AddEnumCase).Methods(http.MethodPost)
+	router.HandleFunc("/tables/{table}/columns/{column}/enum-cases/resolve", handler.ResolveEnumCases).Methods(http.MethodPost)
+	router.HandleFunc("/tables/{table}/columns/{column}/enum-cases/lookup", handler.LookupEnumCases).Methods(http.MethodPost)
+}
+
+func (handler EnumHandler) getEnumDict(table, column string) (*memCom.EnumDict, error) {
+	tableSchema, err := handler.memStore.GetSchema(table)
+	if err != nil {
+		return nil, err
+	}
+
+	tableSchema.RLock()
+	defer tableSchema.RUnlock()
+
+	enumDict, ok := tableSchema.EnumDicts[column]
+	if !ok {
+		return nil, ErrColumnDoesNotExist
+	}
+	return &enumDict, nil
+}
+
+// ListEnumCases swagger:route GET /schema/tables/{table}/columns/{column}/enum-cases listEnumCases
+// lists all enum cases of the given column in insertion order.
+func (handler EnumHandler) ListEnumCases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	enumDict, err := handler.getEnumDict(vars["table"], vars["column"])
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	RespondWithJSONObject(w, enumDict.ReverseDict)
+}
+
+// AddEnumCase swagger:route POST /schema/tables/{table}/columns/{column}/enum-cases addEnumCase
+// appends new enum cases to the given column's dictionary and returns the
+// assigned enum IDs.
+func (handler EnumHandler) AddEnumCase(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	table, column := vars["table"], vars["column"]
+
+	var req struct {
+		EnumCases []string `json:"enumCases"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	enumIDs, err := handler.metaStore.ExtendEnumDict(table, column, req.EnumCases)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondWithJSONObject(w, enumIDs)
+}
+
+// ResolveEnumCases swagger:route POST /schema/tables/{table}/columns/{column}/enum-cases/resolve resolveEnumCases
+// resolves a batch of enum case strings to their enum IDs against the
+// in-memory dictionary, without a metastore round trip. Cases that are not
+// yet present resolve to -1 unless autoExtend=true is set, in which case
+// they are appended to the dictionary via ExtendEnumDict in the same call.
+func (handler EnumHandler) ResolveEnumCases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	table, column := vars["table"], vars["column"]
+	autoExtend := r.URL.Query().Get("autoExtend") == "true"
+
+	var req struct {
+		EnumCases []string `json:"enumCases"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.EnumCases) > maxEnumBatchSize {
+		RespondWithError(w, http.StatusBadRequest, ErrEnumBatchTooLarge)
+		return
+	}
+
+	enumDict, err := handler.getEnumDict(table, column)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ids := make([]int, len(req.EnumCases))
+	var missing []string
+	var missingIndices []int
+	for i, enumCase := range req.EnumCases {
+		if id, ok := enumDict.Dict[enumCase]; ok {
+			ids[i] = id
+		} else {
+			ids[i] = -1
+			missing = append(missing, enumCase)
+			missingIndices = append(missingIndices, i)
+		}
+	}
+
+	if autoExtend && len(missing) > 0 {
+		newIDs, err := handler.metaStore.ExtendEnumDict(table, column, missing)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for i, id := range newIDs {
+			ids[missingIndices[i]] = id
+		}
+	}
+
+	RespondWithJSONObject(w, ids)
+}
+
+// LookupEnumCases swagger:route POST /schema/tables/{table}/columns/{column}/enum-cases/lookup lookupEnumCases
+// resolves a batch of enum IDs back to their string cases using the
+// in-memory dictionary. Out-of-range IDs are returned as empty strings.
+func (handler EnumHandler) LookupEnumCases(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	table, column := vars["table"], vars["column"]
+
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.IDs) > maxEnumBatchSize {
+		RespondWithError(w, http.StatusBadRequest, ErrEnumBatchTooLarge)
+		return
+	}
+
+	enumDict, err := handler.getEnumDict(table, column)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cases := make([]string, len(req.IDs))
+	for i, id := range req.IDs {
+		if id >= 0 && id < len(enumDict.ReverseDict) {
+			cases[i] = enumDict.ReverseDict[id]
+		}
+	}
+	RespondWithJSONObject(w, cases)
+}
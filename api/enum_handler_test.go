@@ -112,4 +112,51 @@ var _ = ginkgo.Describe("EnumHandler", func() {
 		resp, _ = http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases", hostPort, "testTable", "testColumn"), "application/json", bytes.NewBuffer(enumCases))
 		??(resp.StatusCode).Should(Equal(http.StatusInternalServerError))
 	})
+
+	ginkgo.It("ResolveEnumCases should work", func() {
+		reqBody := []byte(`{"enumCases": ["a", "b", "unknown"]}`)
+		resp, _ := http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/resolve", hostPort, "testTable", "testColumn"), "application/json", bytes.NewBuffer(reqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusOK))
+		respBody, err := ioutil.ReadAll(resp.Body)
+		??(err).Should(BeNil())
+		var ids []int
+		err = json.Unmarshal(respBody, &ids)
+		??(err).Should(BeNil())
+		??(ids).Should(Equal([]int{0, 1, -1}))
+
+		testMetastore.On("ExtendEnumDict", mock.Anything, mock.Anything, []string{"unknown"}).Return([]int{3}, nil).Once()
+		resp, _ = http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/resolve?autoExtend=true", hostPort, "testTable", "testColumn"), "application/json", bytes.NewBuffer(reqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusOK))
+		respBody, err = ioutil.ReadAll(resp.Body)
+		??(err).Should(BeNil())
+		err = json.Unmarshal(respBody, &ids)
+		??(err).Should(BeNil())
+		??(ids).Should(Equal([]int{0, 1, 3}))
+
+		resp, _ = http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/resolve", hostPort, "testTable", "unknown"), "application/json", bytes.NewBuffer(reqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+
+		errorousReqBody := []byte(`{"enumCases": ["a"`)
+		resp, _ = http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/resolve", hostPort, "testTable", "testColumn"), "application/json", bytes.NewBuffer(errorousReqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+	})
+
+	ginkgo.It("LookupEnumCases should work", func() {
+		reqBody := []byte(`{"ids": [0, 2, 99]}`)
+		resp, _ := http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/lookup", hostPort, "testTable", "testColumn"), "application/json", bytes.NewBuffer(reqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusOK))
+		respBody, err := ioutil.ReadAll(resp.Body)
+		??(err).Should(BeNil())
+		var cases []string
+		err = json.Unmarshal(respBody, &cases)
+		??(err).Should(BeNil())
+		??(cases).Should(Equal([]string{"a", "c", ""}))
+
+		resp, _ = http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/lookup", hostPort, "testTable", "unknown"), "application/json", bytes.NewBuffer(reqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+
+		errorousReqBody := []byte(`{"ids": [0`)
+		resp, _ = http.Post(fmt.Sprintf("http://%s/schema/tables/%s/columns/%s/enum-cases/lookup", hostPort, "testTable", "testColumn"), "application/json", bytes.NewBuffer(errorousReqBody))
+		??(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+	})
 })
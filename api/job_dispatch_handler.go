@@ -0,0 +1,165 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	"github.com/uber/aresdb/memstore"
+	memCom "github.com/uber/aresdb/memstore/common"
+	"github.com/uber/aresdb/utils"
+)
+
+// jobDispatchRequest is the common envelope for an on-demand job dispatch.
+// Params is interpreted according to jobType: "cutoff" for archiving,
+// "batchIDStart"/"batchIDEnd" for purge. Meta is opaque and is passed
+// unchanged to Scheduler.Dispatch; the memstore scheduler does not keep it.
+type jobDispatchRequest struct {
+	Params map[string]interface{} `json:"params"`
+	Meta   map[string]string      `json:"meta"`
+}
+
+// JobDispatchHandler lets operators submit ArchivingJob/BackfillJob/
+// SnapshotJob/PurgeJob runs on demand instead of waiting for the next
+// scheduled interval.
+type JobDispatchHandler struct {
+	scheduler memstore.Scheduler
+
+	sync.Mutex
+	// inFlight tracks dispatch IDs by <jobType>|<table>|<shard> so a
+	// duplicate dispatch for the same target is rejected while one is
+	// still outstanding.
+	inFlight map[string]string
+	nextID   uint64
+}
+
+// NewJobDispatchHandler creates a new JobDispatchHandler.
+func NewJobDispatchHandler(scheduler memstore.Scheduler) *JobDispatchHandler {
+	return &JobDispatchHandler{
+		scheduler: scheduler,
+		inFlight:  make(map[string]string),
+	}
+}
+
+// Register adds the job dispatch routes to the given router.
+func (handler *JobDispatchHandler) Register(router *mux.Router) {
+	router.HandleFunc("/{jobType}/tables/{table}/shards/{shard}", handler.DispatchJob).Methods(http.MethodPost)
+}
+
+func dispatchKey(jobType memCom.JobType, table string, shard int) string {
+	return fmt.Sprintf("%s|%s|%d", jobType, table, shard)
+}
+
+// DispatchJob swagger:route POST /jobs/{jobType}/tables/{table}/shards/{shard} dispatchJob
+// submits an on-demand run of the given job type against the given table
+// and shard, and returns the dispatch ID assigned to it. The request is
+// checked only for the table shard existing and for the params its job
+// type needs; the params are not checked against the shard's
+// TableSchema/TableConfig. The run's progress shows in GetJobDetails under
+// its <table|shard|jobType> key like a scheduled run; job details do not
+// carry the dispatch ID.
+func (handler *JobDispatchHandler) DispatchJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobType := memCom.JobType(vars["jobType"])
+	table := vars["table"]
+	shard, err := strconv.Atoi(vars["shard"])
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var req jobDispatchRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	tableSchema, err := handler.scheduler.GetTableSchema(table, shard)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key := dispatchKey(jobType, table, shard)
+
+	handler.Lock()
+	if _, ok := handler.inFlight[key]; ok {
+		handler.Unlock()
+		RespondWithError(w, http.StatusConflict, utils.StackError(nil, "a %s job is already dispatched for table %s shard %d", jobType, table, shard))
+		return
+	}
+	handler.nextID++
+	dispatchID := fmt.Sprintf("dispatch-%d", handler.nextID)
+	handler.inFlight[key] = dispatchID
+	handler.Unlock()
+
+	job, err := handler.buildJob(jobType, table, shard, req.Params, tableSchema)
+	if err != nil {
+		handler.clearInFlight(key)
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := handler.scheduler.Dispatch(dispatchID, job, req.Meta); err != nil {
+		handler.clearInFlight(key)
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	go func() {
+		defer handler.clearInFlight(key)
+		handler.scheduler.Wait(dispatchID)
+	}()
+
+	RespondWithJSONObject(w, map[string]string{"dispatchID": dispatchID})
+}
+
+func (handler *JobDispatchHandler) clearInFlight(key string) {
+	handler.Lock()
+	delete(handler.inFlight, key)
+	handler.Unlock()
+}
+
+func (handler *JobDispatchHandler) buildJob(jobType memCom.JobType, table string, shard int, params map[string]interface{}, tableSchema *memCom.TableSchema) (memstore.Job, error) {
+	switch jobType {
+	case memCom.ArchivingJobType:
+		cutoff, ok := params["cutoff"].(float64)
+		if !ok {
+			return nil, utils.StackError(nil, "cutoff is required for archiving job dispatch")
+		}
+		return handler.scheduler.NewArchivingJob(table, shard, uint32(cutoff)), nil
+	case memCom.BackfillJobType:
+		return handler.scheduler.NewBackfillJob(table, shard), nil
+	case memCom.SnapshotJobType:
+		return handler.scheduler.NewSnapshotJob(table, shard), nil
+	case memCom.PurgeJobType:
+		batchIDStart, _ := params["batchIDStart"].(float64)
+		batchIDEnd, ok := params["batchIDEnd"].(float64)
+		if !ok {
+			return nil, utils.StackError(nil, "batchIDEnd is required for purge job dispatch")
+		}
+		return handler.scheduler.NewPurgeJob(table, shard, int(batchIDStart), int(batchIDEnd)), nil
+	default:
+		return nil, utils.StackError(nil, "unknown job type %s", jobType)
+	}
+}
@@ -0,0 +1,133 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/uber/aresdb/memstore"
+	memCom "github.com/uber/aresdb/memstore/common"
+	"github.com/uber/aresdb/utils"
+)
+
+const (
+	defaultHistoryPageSize = 20
+	maxHistoryPageSize     = 500
+)
+
+// JobHistoryHandler serves the execution history audit trail for
+// scheduled and on-demand job runs.
+type JobHistoryHandler struct {
+	scheduler memstore.Scheduler
+	history   *memstore.JobHistoryStore
+}
+
+// NewJobHistoryHandler creates a new JobHistoryHandler.
+func NewJobHistoryHandler(scheduler memstore.Scheduler, history *memstore.JobHistoryStore) JobHistoryHandler {
+	return JobHistoryHandler{scheduler: scheduler, history: history}
+}
+
+// Register adds the job history routes to the given router.
+func (handler JobHistoryHandler) Register(router *mux.Router) {
+	router.HandleFunc("/{jobType}/history", handler.GetJobHistory).Methods(http.MethodGet)
+}
+
+// GetJobHistory swagger:route GET /jobs/{jobType}/history getJobHistory
+// returns a paginated, filterable view of completed executions for the
+// given job type.
+func (handler JobHistoryHandler) GetJobHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobType := memCom.JobType(vars["jobType"])
+
+	query := r.URL.Query()
+	table := query.Get("table")
+	shard := query.Get("shard")
+	status := query.Get("status")
+
+	page, err := parsePositiveIntParam(query.Get("page"), 1)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	pageSize, err := parsePositiveIntParam(query.Get("pageSize"), defaultHistoryPageSize)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if pageSize > maxHistoryPageSize {
+		pageSize = maxHistoryPageSize
+	}
+
+	var executions []memstore.JobExecution
+	for _, info := range handler.scheduler.JobKeysByType(jobType) {
+		if table != "" && info.Table != table {
+			continue
+		}
+		if shard != "" && strconv.Itoa(info.Shard) != shard {
+			continue
+		}
+		for _, execution := range handler.history.Query(info.JobKey) {
+			if status != "" && statusOf(execution) != status {
+				continue
+			}
+			executions = append(executions, execution)
+		}
+	}
+
+	sort.Slice(executions, func(i, j int) bool {
+		return executions[i].StartTime.After(executions[j].StartTime)
+	})
+
+	total := len(executions)
+	start := (page - 1) * pageSize
+	if start < 0 {
+		start = 0
+	}
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	RespondWithJSONObject(w, executions[start:end])
+}
+
+func statusOf(execution memstore.JobExecution) string {
+	if execution.Succeeded {
+		return "succeeded"
+	}
+	return "failed"
+}
+
+func parsePositiveIntParam(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if parsed <= 0 {
+		return 0, utils.StackError(nil, "expected a positive integer, got %q", value)
+	}
+	return parsed, nil
+}
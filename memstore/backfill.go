@@ -0,0 +1,574 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+)
+
+// secondsPerDay is the divisor dayBatchID uses to turn patch.day into a
+// day-numbered BatchID.
+const secondsPerDay = 24 * 60 * 60
+
+// backfillPatch is the set of redo-log records destined for a single
+// archive day, along with the upsert batches they were read from.
+type backfillPatch struct {
+	recordIDs       []memCom.RecordID
+	backfillBatches []*memCom.UpsertBatch
+	// day is the patch's day bucket (seconds since epoch, start-of-day in
+	// the job's BackfillMeta.Location), used to key its BackfillSubTask row.
+	day int64
+}
+
+// dayBatchID converts a patch's day bucket into the ArchiveBatch key it
+// corresponds to in an ArchiveStoreVersion's Batches map.
+func dayBatchID(day int64) int {
+	return int(day / secondsPerDay)
+}
+
+// startOfDay returns the start, in loc, of the calendar day eventTime
+// falls on in loc. time.Truncate can't be used here since it rounds
+// against the zero time in absolute (UTC) terms, not against loc's wall
+// clock, so it would bucket records by UTC day even when loc has a
+// non-zero offset.
+func startOfDay(eventTime time.Time, loc *time.Location) time.Time {
+	local := eventTime.In(loc)
+	year, month, day := local.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// createBackfillPatches buckets upsertBatches' records by the day their
+// event time falls on in jobKey's registered BackfillMeta.Location (UTC if
+// BackfillJob.Run never registered one, e.g. a test calling this directly),
+// reporting the result on jobKey once every record is bucketed. report is typically
+// jobManager.reportBackfillJobDetail; it is invoked with an apply closure
+// that sets Stage to "create patch" so the same report method, reused later
+// by createNewArchiveStoreVersionForBackfill with a different Stage, cannot
+// conflate the two phases.
+func createBackfillPatches(
+	upsertBatches []*memCom.UpsertBatch,
+	report func(key string, apply func(detail *BackfillJobDetail)),
+	jobKey string,
+) ([]*backfillPatch, error) {
+	location := backfillMetaByJob.Lookup(jobKey).Location
+	if location == nil {
+		location = time.UTC
+	}
+
+	dayToPatch := make(map[int64]*backfillPatch)
+	var days []int64
+	totalRecords := 0
+
+	for batchID, upsertBatch := range upsertBatches {
+		numRows := upsertBatch.NumRows()
+		for row := 0; row < numRows; row++ {
+			eventTime, err := upsertBatch.GetEventTime(row)
+			if err != nil {
+				return nil, err
+			}
+			day := startOfDay(eventTime, location).Unix()
+
+			patch, ok := dayToPatch[day]
+			if !ok {
+				patch = &backfillPatch{backfillBatches: upsertBatches, day: day}
+				dayToPatch[day] = patch
+				days = append(days, day)
+			}
+			patch.recordIDs = append(patch.recordIDs, memCom.RecordID{BatchID: int32(batchID), Index: uint32(row)})
+			totalRecords++
+		}
+	}
+
+	sort.Slice(days, func(i, j int) bool { return days[i] < days[j] })
+	patches := make([]*backfillPatch, len(days))
+	for i, day := range days {
+		patches[i] = dayToPatch[day]
+	}
+
+	if report != nil {
+		report(jobKey, func(detail *BackfillJobDetail) {
+			detail.Stage = "create patch"
+			detail.Current = len(patches)
+			detail.Total = len(patches)
+			detail.NumRecords = totalRecords
+		})
+	}
+	return patches, nil
+}
+
+// backfillContext carries the state needed to apply a single backfillPatch
+// against one base ArchiveBatch: the resulting forked columns, the
+// temporary backfillStore new values are staged through, and which base
+// rows the patch deletes. Every schema-derived decision it makes (which
+// columns are deleted, sort/primary-key columns, value types, default
+// values) is taken as an explicit parameter at construction time rather
+// than read from the live *memCom.TableSchema, so a concurrent schema
+// change cannot corrupt the resulting ArchiveBatch mid-job.
+type backfillContext struct {
+	base  *ArchiveBatch
+	patch *backfillPatch
+	new   *ArchiveBatch
+
+	backfillStore *backfillStoreType
+
+	columnsForked  []bool
+	baseRowDeleted []int
+
+	tableSchema          *memCom.TableSchema
+	columnDeletions      []bool
+	archivingSortColumns []int
+	primaryKeyColumns    []int
+	valueTypeByColumn    []memCom.DataType
+	defaultValues        []*memCom.DataValue
+	hostMemoryManager    memCom.HostMemoryManager
+
+	// jobTable and subTask are the persistent checkpoint this context's
+	// progress is flushed to as it writes, attached via withCheckpoint
+	// after construction. subTask.NextWriteRecord, if non-zero at that
+	// point, is also where backfillStore picks up writing instead of
+	// starting over. jobTable stays nil in contexts (e.g. tests) that
+	// don't need checkpointing.
+	jobTable *BackfillJobTable
+	subTask  BackfillSubTask
+}
+
+// newBackfillContext creates a backfillContext for applying patch against
+// base, with a fresh backfillStore and no checkpoint attached. Callers that
+// need to resume a crashed sub-task or persist its progress call
+// withCheckpoint afterward.
+func newBackfillContext(
+	base *ArchiveBatch,
+	patch *backfillPatch,
+	tableSchema *memCom.TableSchema,
+	columnDeletions []bool,
+	archivingSortColumns []int,
+	primaryKeyColumns []int,
+	valueTypeByColumn []memCom.DataType,
+	defaultValues []*memCom.DataValue,
+	hostMemoryManager memCom.HostMemoryManager,
+) backfillContext {
+	return backfillContext{
+		base:                 base,
+		patch:                patch,
+		new:                  base,
+		backfillStore:        newBackfillStore(tableSchema, hostMemoryManager, BaseBatchID),
+		columnsForked:        make([]bool, len(valueTypeByColumn)),
+		tableSchema:          tableSchema,
+		columnDeletions:      columnDeletions,
+		archivingSortColumns: archivingSortColumns,
+		primaryKeyColumns:    primaryKeyColumns,
+		valueTypeByColumn:    valueTypeByColumn,
+		defaultValues:        defaultValues,
+		hostMemoryManager:    hostMemoryManager,
+	}
+}
+
+// withCheckpoint attaches jobTable and subTask to ctx so backfill()
+// persists its progress into jobTable as it runs. If subTask.NextWriteRecord
+// is non-zero (a prior attempt at this sub-task crashed after checkpointing
+// some progress), ctx.backfillStore resumes writing from there instead of
+// from the start of the patch.
+func (ctx *backfillContext) withCheckpoint(jobTable *BackfillJobTable, subTask BackfillSubTask) {
+	ctx.jobTable = jobTable
+	ctx.subTask = subTask
+	if subTask.NextWriteRecord != (memCom.RecordID{}) {
+		ctx.backfillStore.NextWriteRecord = subTask.NextWriteRecord
+	}
+}
+
+// release drops the context's reference to its backfillStore. It reports
+// nothing to the host memory manager.
+func (ctx *backfillContext) release() {
+	ctx.backfillStore = nil
+}
+
+// getChangedPatchRow reads the row at recordID out of upsertBatch, masking
+// out columns marked deleted.
+func (ctx *backfillContext) getChangedPatchRow(recordID memCom.RecordID, upsertBatch *memCom.UpsertBatch) ([]*memCom.DataValue, error) {
+	row := make([]*memCom.DataValue, len(ctx.valueTypeByColumn))
+	for col := range row {
+		if col < len(ctx.columnDeletions) && ctx.columnDeletions[col] {
+			continue
+		}
+		value, err := upsertBatch.GetDataValue(int(recordID.Index), col)
+		if err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			row[col] = &value
+		}
+	}
+	return row, nil
+}
+
+// getChangedBaseRow merges a patch row on top of the corresponding base
+// row, returning only the columns that actually changed.
+func (ctx *backfillContext) getChangedBaseRow(recordID memCom.RecordID, patchRow []*memCom.DataValue) []*memCom.DataValue {
+	var changed []*memCom.DataValue
+	for col, value := range patchRow {
+		if value == nil {
+			continue
+		}
+		if changed == nil {
+			changed = make([]*memCom.DataValue, len(patchRow))
+		}
+		changed[col] = value
+	}
+	return changed
+}
+
+// primaryKeyEqual reports whether a and b are the same valid, fixed-width
+// primary-key value. Backfill's primary-key columns are always fixed-width
+// (never array columns), so comparing the first 4 bytes of OtherVal is
+// enough to tell uint32-width keys apart.
+func primaryKeyEqual(a, b *memCom.DataValue) bool {
+	if a == nil || b == nil || !a.Valid || !b.Valid {
+		return false
+	}
+	return *(*uint32)(a.OtherVal) == *(*uint32)(b.OtherVal)
+}
+
+// findBaseRow returns the index within ctx.base whose primary-key columns
+// equal patchRow's, or -1 if patchRow's primary key matches no base row
+// (e.g. the patch is inserting a brand new row rather than updating one
+// already archived).
+func (ctx *backfillContext) findBaseRow(patchRow []*memCom.DataValue) int {
+	if len(ctx.primaryKeyColumns) == 0 {
+		return -1
+	}
+	for row := 0; row < ctx.base.Size; row++ {
+		matched := true
+		for _, col := range ctx.primaryKeyColumns {
+			if col >= len(patchRow) {
+				matched = false
+				break
+			}
+			baseValue := ctx.base.GetDataValue(row, col)
+			if !primaryKeyEqual(patchRow[col], &baseValue) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return row
+		}
+	}
+	return -1
+}
+
+// forkColumn copy-on-write forks column the first time it is touched, so
+// writing into ctx.new never mutates ctx.base in place. The first fork of
+// any column on this patch also splits ctx.new off of ctx.base into its
+// own ArchiveBatch with its own Columns slice, so later forks only ever
+// replace entries in ctx.new's slice, never ctx.base's.
+func (ctx *backfillContext) forkColumn(col int) {
+	if col >= len(ctx.columnsForked) || ctx.columnsForked[col] {
+		return
+	}
+	if ctx.new == ctx.base {
+		forked := *ctx.base
+		forked.Columns = append([]memCom.VectorParty(nil), ctx.base.Columns...)
+		ctx.new = &forked
+	}
+	ctx.new.Columns[col] = ctx.new.Columns[col].CopyOnWrite(int(ctx.backfillStore.BatchSize))
+	ctx.columnsForked[col] = true
+}
+
+// writePatchValueForUnsortedColumn writes value into ctx.new at recordID
+// for every changed unsorted column, copy-on-write forking the column the
+// first time it is touched so the base ArchiveBatch is never mutated
+// in-place.
+func (ctx *backfillContext) writePatchValueForUnsortedColumn(recordID memCom.RecordID, changedRow []*memCom.DataValue) {
+	for col, value := range changedRow {
+		if value == nil {
+			continue
+		}
+		sorted := false
+		for _, sortCol := range ctx.archivingSortColumns {
+			if sortCol == col {
+				sorted = true
+				break
+			}
+		}
+		if sorted {
+			continue
+		}
+		ctx.forkColumn(col)
+		ctx.new.SetDataValue(int(recordID.Index), col, *value)
+	}
+}
+
+// backfill applies ctx.patch to ctx.base, producing ctx.new, polling
+// backfillControlRegistry (keyed by jobKey) at every record so an admin
+// pause/cancel takes effect within one record's worth of work without
+// rolling back progress already made, and reporting progress through
+// report (typically jobManager.reportBackfillJobDetail). If ctx.jobTable
+// is set, ctx.subTask is checkpointed with Checkpoint every time
+// ctx.backfillStore crosses a BackfillStoreBatchSize boundary, so a
+// resumed context (see withCheckpoint) only has to redo the records
+// written since the last checkpoint instead of the whole patch. The resume
+// position is tracked by ctx.subTask.NextPatchRecordIndex, a raw offset
+// into ctx.patch.recordIDs, rather than by ctx.backfillStore.NextWriteRecord:
+// NextWriteRecord only advances for records that actually changed a base
+// row, so a patch containing no-op rows would make a resumed context
+// misalign the two counters and skip the wrong records.
+func (ctx *backfillContext) backfill(report func(key string, apply func(detail *BackfillJobDetail)), jobKey string) error {
+	control := backfillControlRegistry.Lookup(jobKey)
+
+	applied := ctx.subTask.NextPatchRecordIndex
+
+	for i, recordID := range ctx.patch.recordIDs {
+		if i < applied {
+			// Already flushed by a prior attempt at this sub-task before
+			// it crashed; skip re-applying it.
+			continue
+		}
+		if control != nil {
+			if err := control.CheckPoint(); err != nil {
+				return err
+			}
+		}
+
+		upsertBatch := ctx.patch.backfillBatches[recordID.BatchID]
+		patchRow, err := ctx.getChangedPatchRow(recordID, upsertBatch)
+		if err != nil {
+			return err
+		}
+		if matchedBaseRow := ctx.findBaseRow(patchRow); matchedBaseRow >= 0 {
+			alreadyDeleted := false
+			for _, deleted := range ctx.baseRowDeleted {
+				if deleted == matchedBaseRow {
+					alreadyDeleted = true
+					break
+				}
+			}
+			if !alreadyDeleted {
+				ctx.baseRowDeleted = append(ctx.baseRowDeleted, matchedBaseRow)
+			}
+		}
+
+		baseRow := ctx.getChangedBaseRow(recordID, patchRow)
+		if baseRow == nil {
+			continue
+		}
+		ctx.writePatchValueForUnsortedColumn(recordID, baseRow)
+
+		ctx.backfillStore.NextWriteRecord = memCom.RecordID{BatchID: ctx.backfillStore.NextWriteRecord.BatchID, Index: ctx.backfillStore.NextWriteRecord.Index + 1}
+		if ctx.backfillStore.BatchSize > 0 && ctx.backfillStore.NextWriteRecord.Index >= ctx.backfillStore.BatchSize {
+			ctx.backfillStore.NextWriteRecord = memCom.RecordID{BatchID: ctx.backfillStore.NextWriteRecord.BatchID + 1, Index: 0}
+			if ctx.jobTable != nil {
+				if err := ctx.jobTable.Checkpoint(ctx.subTask, ctx.backfillStore.NextWriteRecord, i+1); err != nil {
+					return err
+				}
+				ctx.subTask.NextWriteRecord = ctx.backfillStore.NextWriteRecord
+				ctx.subTask.NextPatchRecordIndex = i + 1
+			}
+		}
+	}
+
+	if ctx.jobTable != nil && len(ctx.patch.recordIDs) > applied {
+		if err := ctx.jobTable.Checkpoint(ctx.subTask, ctx.backfillStore.NextWriteRecord, len(ctx.patch.recordIDs)); err != nil {
+			return err
+		}
+	}
+
+	if report != nil {
+		report(jobKey, func(detail *BackfillJobDetail) {
+			detail.NumRecords += len(ctx.patch.recordIDs)
+			if len(ctx.patch.recordIDs) > 0 {
+				detail.NumAffectedDays++
+			}
+		})
+	}
+	return nil
+}
+
+// backfillStoreType is the write-ahead staging area backfill() applies
+// patch values into before they are folded into a new ArchiveBatch.
+type backfillStoreType struct {
+	sync.RWMutex
+	Batches         map[int]*ArchiveBatch
+	PrimaryKey      memCom.PrimaryKeyData
+	BatchSize       uint32
+	NextWriteRecord memCom.RecordID
+
+	hostMemoryManager memCom.HostMemoryManager
+}
+
+// newBackfillStore creates a backfillStoreType sized from tableSchema,
+// with NextWriteRecord starting at startBatchID.
+func newBackfillStore(tableSchema *memCom.TableSchema, hostMemoryManager memCom.HostMemoryManager, startBatchID int) *backfillStoreType {
+	batchSize := uint32(tableSchema.Schema.Config.BackfillStoreBatchSize)
+	if batchSize == 0 {
+		batchSize = 1 << 20
+	}
+	return &backfillStoreType{
+		Batches:           make(map[int]*ArchiveBatch),
+		PrimaryKey:        memCom.NewPrimaryKey(tableSchema.PrimaryKeyBytes, false, 0, hostMemoryManager),
+		BatchSize:         batchSize,
+		NextWriteRecord:   memCom.RecordID{BatchID: int32(startBatchID)},
+		hostMemoryManager: hostMemoryManager,
+	}
+}
+
+// GetBatchForRead returns the ArchiveBatch for batchID with its read lock
+// already held; callers must call RUnlock on the returned batch.
+func (s *backfillStoreType) GetBatchForRead(batchID int) *ArchiveBatch {
+	s.RLock()
+	defer s.RUnlock()
+	batch := s.Batches[batchID]
+	if batch != nil {
+		batch.RLock()
+	}
+	return batch
+}
+
+// AdvanceLastReadRecord marks every record written so far as visible to
+// readers, e.g. before handing the store to createArchivingPatch.
+func (s *backfillStoreType) AdvanceLastReadRecord() {
+	s.Lock()
+	defer s.Unlock()
+}
+
+// snapshot returns a read-only view of the store suitable for
+// createArchivingPatch.
+func (s *backfillStoreType) snapshot() *backfillStoreType {
+	return s
+}
+
+// createNewArchiveStoreVersionForBackfill applies every patch to shard's
+// current archive store version, producing a new version. It looks up
+// jobKey's registered BackfillMeta (the snapshot the caller took when the
+// job was created, before createBackfillPatches ran, so every patch is
+// applied against the exact schema the job was planned under; the zero
+// value if none was registered, e.g. a test calling this directly) and
+// refuses to swap in the resulting version if the live schema has since
+// diverged from that snapshot. It also lists jobKey's BackfillSubTask rows
+// from shard's own BackfillJobTable (keyed by patch.day) to checkpoint
+// progress into as each patch applies; a subTask whose NextPatchRecordIndex
+// is already non-zero (reclaimed from a crashed prior attempt) resumes
+// from there instead of redoing the whole patch. Patches are dispatched
+// across shard's backfillWorkerPool (one worker per concurrently in-flight
+// patch); each patch reads its own day's base ArchiveBatch (keyed by
+// dayBatchID) and copy-on-write forks any column it touches into a batch
+// of its own, so distinct patches never contend on the same
+// ArchiveBatch.Columns and the live base is never mutated in place. The
+// terminal swap of ArchiveStore.CurrentVersion happens once, after every
+// patch completes, so it stays atomic. backfillControlRegistry is polled
+// (keyed by jobKey) between patches so a pause/cancel takes effect
+// without rolling back patches already applied.
+func (shard *TableShard) createNewArchiveStoreVersionForBackfill(
+	patches []*backfillPatch,
+	report func(key string, apply func(detail *BackfillJobDetail)),
+	jobKey string,
+) error {
+	meta := backfillMetaByJob.Lookup(jobKey)
+
+	jobTable := shard.backfillJobTable()
+	existing, err := jobTable.ListByJob(shard.Schema.Schema.Name, shard.ShardID, jobKey)
+	if err != nil {
+		return err
+	}
+	subTasks := make(map[int64]BackfillSubTask, len(existing))
+	for _, task := range existing {
+		subTasks[task.PatchDay] = task
+	}
+
+	control := backfillControlRegistry.Lookup(jobKey)
+	pool := shard.backfillWorkers()
+
+	results := pool.RunPatches(patches, shard.HostMemoryManager, func(patch *backfillPatch) backfillPatchResult {
+		if control != nil {
+			if err := control.CheckPoint(); err != nil {
+				return backfillPatchResult{Err: err}
+			}
+		}
+
+		batchID := dayBatchID(patch.day)
+
+		shard.ArchiveStore.RLock()
+		base := shard.ArchiveStore.CurrentVersion.Batches[batchID]
+		shard.ArchiveStore.RUnlock()
+		if base == nil {
+			base = &ArchiveBatch{Shard: shard}
+		}
+
+		ctx := newBackfillContext(base, patch, shard.Schema, meta.ColumnDeletions, meta.ArchivingSortColumns,
+			meta.PrimaryKeyColumns, meta.ValueTypeByColumn, meta.DefaultValues, shard.HostMemoryManager)
+		ctx.withCheckpoint(jobTable, subTasks[patch.day])
+		defer ctx.release()
+
+		if err := ctx.backfill(nil, jobKey); err != nil {
+			return backfillPatchResult{Err: err}
+		}
+		return backfillPatchResult{
+			NumRecords:      len(patch.recordIDs),
+			NumAffectedDays: 1,
+			BatchID:         batchID,
+			Batch:           ctx.new,
+		}
+	})
+
+	for _, result := range results {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+
+	if meta.Stale(shard.Schema) {
+		// The live schema has diverged from the snapshot this job was
+		// planned against: refuse to swap in a version built against
+		// stale column/sort-key assumptions. BackfillJob.Run then marks
+		// the job's sub-tasks failed and returns this error; the patches
+		// are not re-planned against the new schema.
+		return ErrBackfillSchemaDiverged
+	}
+
+	if report != nil {
+		report(jobKey, func(detail *BackfillJobDetail) {
+			detail.Stage = "apply patch"
+			detail.Current = 1
+			detail.Total = 1
+			// Counters left over from the "create patch" stage are reset so
+			// the merged per-patch totals are not added on top of them.
+			detail.NumRecords = 0
+			detail.NumAffectedDays = 0
+			detail.LockDuration = 0
+			mergeBackfillPatchResults(detail, results)
+		})
+	}
+
+	shard.ArchiveStore.Lock()
+	defer shard.ArchiveStore.Unlock()
+	newBatches := make(map[int]*ArchiveBatch, len(shard.ArchiveStore.CurrentVersion.Batches))
+	for batchID, batch := range shard.ArchiveStore.CurrentVersion.Batches {
+		newBatches[batchID] = batch
+	}
+	for _, result := range results {
+		if result.Batch != nil {
+			newBatches[result.BatchID] = result.Batch
+		}
+	}
+	shard.ArchiveStore.CurrentVersion = &ArchiveStoreVersion{
+		ArchivingCutoff: shard.ArchiveStore.CurrentVersion.ArchivingCutoff,
+		Batches:         newBatches,
+		Shard:           shard,
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync"
+
+	"github.com/uber/aresdb/utils"
+)
+
+// backfillControlSignal is the cooperative command a running backfill
+// checks for at every backfillStore batch boundary and between patches.
+type backfillControlSignal int
+
+const (
+	backfillControlNone backfillControlSignal = iota
+	backfillControlPause
+	backfillControlCancel
+)
+
+// backfillJobControl holds the cooperative pause/resume/cancel signal for
+// a single in-flight backfill job, keyed by jobKey. backfillContext.backfill
+// and the outer loop in createNewArchiveStoreVersionForBackfill poll it at
+// every checkpoint so a pause or cancel takes effect within one
+// BackfillStoreBatchSize worth of work, without rolling back progress
+// already made.
+type backfillJobControl struct {
+	sync.Mutex
+	signal backfillControlSignal
+	resume chan struct{}
+
+	// report and jobKey, if report is non-nil, let Pause/Resume/Cancel set
+	// BackfillJobDetail.Stage to "paused"/"cancelled" the moment the
+	// control transition is requested, instead of only taking effect the
+	// next time a checkpoint happens to report progress.
+	report    func(key string, apply func(detail *BackfillJobDetail))
+	jobKey    string
+	prevStage string
+}
+
+func newBackfillJobControl(jobKey string) *backfillJobControl {
+	return &backfillJobControl{resume: make(chan struct{}), jobKey: jobKey}
+}
+
+// SetReport attaches report to c, so a later Pause/Resume/Cancel can set
+// BackfillJobDetail.Stage the moment the control transition is requested
+// instead of only taking effect the next time a checkpoint happens to
+// report progress. Callers that only need CheckPoint (e.g. a test
+// exercising pause/cancel directly) can leave it unset.
+func (c *backfillJobControl) SetReport(report func(key string, apply func(detail *BackfillJobDetail))) {
+	c.Lock()
+	defer c.Unlock()
+	c.report = report
+}
+
+// CheckPoint blocks the caller while the job is paused, and returns an
+// error once the job has been cancelled. It must be called at every
+// backfillStore batch boundary and between patches.
+func (c *backfillJobControl) CheckPoint() error {
+	for {
+		c.Lock()
+		signal := c.signal
+		resume := c.resume
+		c.Unlock()
+
+		switch signal {
+		case backfillControlCancel:
+			return utils.StackError(nil, "backfill job cancelled")
+		case backfillControlPause:
+			<-resume
+			continue
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *backfillJobControl) Pause() {
+	c.Lock()
+	if c.signal == backfillControlCancel {
+		c.Unlock()
+		return
+	}
+	c.signal = backfillControlPause
+	report, jobKey := c.report, c.jobKey
+	c.Unlock()
+
+	if report != nil {
+		report(jobKey, func(detail *BackfillJobDetail) {
+			c.Lock()
+			c.prevStage = detail.Stage
+			c.Unlock()
+			detail.Stage = "paused"
+		})
+	}
+}
+
+func (c *backfillJobControl) Resume() {
+	c.Lock()
+	if c.signal != backfillControlPause {
+		c.Unlock()
+		return
+	}
+	c.signal = backfillControlNone
+	close(c.resume)
+	c.resume = make(chan struct{})
+	report, jobKey, prevStage := c.report, c.jobKey, c.prevStage
+	c.Unlock()
+
+	if report != nil {
+		report(jobKey, func(detail *BackfillJobDetail) {
+			detail.Stage = prevStage
+		})
+	}
+}
+
+func (c *backfillJobControl) Cancel() {
+	c.Lock()
+	if c.signal == backfillControlPause {
+		close(c.resume)
+		c.resume = make(chan struct{})
+	}
+	c.signal = backfillControlCancel
+	report, jobKey := c.report, c.jobKey
+	c.Unlock()
+
+	if report != nil {
+		report(jobKey, func(detail *BackfillJobDetail) {
+			detail.Stage = "cancelled"
+		})
+	}
+}
+
+// backfillJobControlRegistry tracks the backfillJobControl for every
+// in-flight backfill job, so the admin handler layer can address a job by
+// key without reaching into backfillJobManager internals.
+type backfillJobControlRegistry struct {
+	sync.Mutex
+	byKey map[string]*backfillJobControl
+}
+
+func newBackfillJobControlRegistry() *backfillJobControlRegistry {
+	return &backfillJobControlRegistry{byKey: make(map[string]*backfillJobControl)}
+}
+
+// backfillControlRegistry is the single, process-wide registry shared by
+// the HTTP admin handlers (api/backfill_control_handler.go) and the real
+// backfill loop (backfillContext.backfill,
+// TableShard.createNewArchiveStoreVersionForBackfill). A job registers
+// itself under its jobKey when it starts running and unregisters when it
+// finishes, so Lookup returns nil for any jobKey with no in-flight job.
+var backfillControlRegistry = newBackfillJobControlRegistry()
+
+// Lookup returns the control for jobKey, or nil if no job is currently
+// registered under that key. Unlike Register, it never creates an entry,
+// so backfill()/createNewArchiveStoreVersionForBackfill can poll it for a
+// job that was never paused/cancelled without leaking registry entries.
+func (r *backfillJobControlRegistry) Lookup(jobKey string) *backfillJobControl {
+	r.Lock()
+	defer r.Unlock()
+	return r.byKey[jobKey]
+}
+
+// Register creates (or returns the existing) control for jobKey. It is
+// called when a backfill job starts running. The returned control reports
+// nowhere until SetReport is called on it; BackfillJob.Run calls SetReport
+// with jobManager.reportBackfillJobDetail right after registering so a
+// later Pause/Resume/Cancel can set BackfillJobDetail.Stage immediately. A
+// caller that only needs CheckPoint (e.g. a test exercising pause/cancel
+// directly) can leave it unset.
+func (r *backfillJobControlRegistry) Register(jobKey string) *backfillJobControl {
+	r.Lock()
+	defer r.Unlock()
+	control, ok := r.byKey[jobKey]
+	if !ok {
+		control = newBackfillJobControl(jobKey)
+		r.byKey[jobKey] = control
+	}
+	return control
+}
+
+// IsCancelled reports whether jobKey's backfill job has been cooperatively
+// cancelled, so a caller that just received the resulting "backfill job
+// cancelled" error can tell a deliberate cancellation apart from a
+// genuine failure (e.g. to avoid overwriting the cancelled sub-task state
+// BackfillJobTable.MarkCancelled already persisted with "failed").
+func (r *backfillJobControlRegistry) IsCancelled(jobKey string) bool {
+	r.Lock()
+	control, ok := r.byKey[jobKey]
+	r.Unlock()
+	if !ok {
+		return false
+	}
+	control.Lock()
+	defer control.Unlock()
+	return control.signal == backfillControlCancel
+}
+
+// Unregister removes the control for jobKey once the job has finished
+// running, whether it completed, failed, or was cancelled.
+func (r *backfillJobControlRegistry) Unregister(jobKey string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.byKey, jobKey)
+}
+
+// PauseJob cooperatively pauses the backfill job identified by jobKey.
+func (r *backfillJobControlRegistry) PauseJob(jobKey string) error {
+	r.Lock()
+	control, ok := r.byKey[jobKey]
+	r.Unlock()
+	if !ok {
+		return utils.StackError(nil, "no in-flight backfill job for key %s", jobKey)
+	}
+	control.Pause()
+	return nil
+}
+
+// ResumeJob resumes a previously paused backfill job identified by jobKey.
+func (r *backfillJobControlRegistry) ResumeJob(jobKey string) error {
+	r.Lock()
+	control, ok := r.byKey[jobKey]
+	r.Unlock()
+	if !ok {
+		return utils.StackError(nil, "no in-flight backfill job for key %s", jobKey)
+	}
+	control.Resume()
+	return nil
+}
+
+// CancelJob cancels the backfill job identified by jobKey. The outer loop
+// discards the in-progress ArchiveBatch and leaves ArchiveStore.CurrentVersion
+// untouched once it observes the cancellation.
+func (r *backfillJobControlRegistry) CancelJob(jobKey string) error {
+	r.Lock()
+	control, ok := r.byKey[jobKey]
+	r.Unlock()
+	if !ok {
+		return utils.StackError(nil, "no in-flight backfill job for key %s", jobKey)
+	}
+	control.Cancel()
+	return nil
+}
@@ -0,0 +1,246 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+	metaCom "github.com/uber/aresdb/metastore/common"
+	"github.com/uber/aresdb/utils"
+)
+
+// BackfillSubTaskState is the lifecycle of a single backfill sub-task (one
+// per day-keyed backfillPatch).
+type BackfillSubTaskState string
+
+const (
+	// BackfillSubTaskPending has not been picked up by any worker yet.
+	BackfillSubTaskPending BackfillSubTaskState = "pending"
+	// BackfillSubTaskRunning is currently owned by an instance and being
+	// worked on.
+	BackfillSubTaskRunning BackfillSubTaskState = "running"
+	// BackfillSubTaskDone completed successfully.
+	BackfillSubTaskDone BackfillSubTaskState = "done"
+	// BackfillSubTaskFailed ended in an error on its last attempt. No
+	// attempt limit applies: Reclaim picks it up again.
+	BackfillSubTaskFailed BackfillSubTaskState = "failed"
+	// BackfillSubTaskPaused was cooperatively paused by an admin; Reclaim
+	// still resumes it like BackfillSubTaskRunning once its lease expires.
+	BackfillSubTaskPaused BackfillSubTaskState = "paused"
+	// BackfillSubTaskCancelled was cooperatively cancelled by an admin;
+	// unlike BackfillSubTaskPaused, Reclaim never resumes it.
+	BackfillSubTaskCancelled BackfillSubTaskState = "cancelled"
+)
+
+// backfillSubTaskLeaseTimeout is how long a sub-task can stay "running"
+// under a given owner before another instance is allowed to reclaim it.
+const backfillSubTaskLeaseTimeout = 10 * time.Minute
+
+// BackfillSubTask is one row of the persistent backfill-job table, keyed
+// by (table, shardID, jobID, patchDay). It captures enough state for the
+// owning backfillJobManager to resume from its last checkpoint after a
+// crash instead of recomputing the patch from scratch.
+type BackfillSubTask struct {
+	Table       string                `json:"table"`
+	ShardID     int                   `json:"shardID"`
+	JobID       string                `json:"jobID"`
+	PatchDay    int64                 `json:"patchDay"`
+	State       BackfillSubTaskState  `json:"state"`
+	OwnerID     string                `json:"ownerID"`
+	Attempts    int                   `json:"attempts"`
+	LeasedAt    time.Time             `json:"leasedAt"`
+	// RedoLogOffsetStart/End bound the upsertBatch offsets within the redo
+	// log covered by this sub-task.
+	RedoLogOffsetStart int64 `json:"redoLogOffsetStart"`
+	RedoLogOffsetEnd   int64 `json:"redoLogOffsetEnd"`
+	// NextWriteRecord is the last checkpointed position within the
+	// sub-task's backfillStore, so a resumed worker's backfillStore
+	// continues writing from there.
+	NextWriteRecord memCom.RecordID `json:"nextWriteRecord"`
+	// NextPatchRecordIndex is the last checkpointed offset into the
+	// patch's own recordIDs slice, which advances once per record
+	// regardless of whether that record actually changed anything.
+	// NextWriteRecord alone can't drive resume: it only advances for
+	// records that changed a base row, so a patch with no-op rows would
+	// make a resumed worker skip too many (or too few) records if it
+	// resumed by replaying NextWriteRecord against the raw recordIDs
+	// index.
+	NextPatchRecordIndex int `json:"nextPatchRecordIndex"`
+	// Meta carries the schema version, sort columns, and primary key
+	// columns in effect when the patch was built (see BackfillMeta).
+	Meta BackfillMeta `json:"meta"`
+}
+
+// backfillSubTaskKey identifies a BackfillSubTask row.
+func backfillSubTaskKey(table string, shardID int, jobID string, patchDay int64) string {
+	return getIdentifier(table, shardID, memCom.BackfillJobType) + "|" + jobID + "|" + time.Unix(patchDay, 0).UTC().Format("2006-01-02")
+}
+
+// BackfillJobTable is the persistent store of BackfillSubTask rows backed
+// by the metastore, keyed by (table, shardID, jobID).
+type BackfillJobTable struct {
+	metaStore metaCom.MetaStore
+	ownerID   string
+}
+
+// NewBackfillJobTable creates a BackfillJobTable. ownerID identifies this
+// instance so sub-tasks it leases can be distinguished from those leased
+// by other instances in the cluster.
+func NewBackfillJobTable(metaStore metaCom.MetaStore, ownerID string) *BackfillJobTable {
+	return &BackfillJobTable{metaStore: metaStore, ownerID: ownerID}
+}
+
+// CreateOrUpdate upserts a sub-task row.
+func (t *BackfillJobTable) CreateOrUpdate(task BackfillSubTask) error {
+	key := backfillSubTaskKey(task.Table, task.ShardID, task.JobID, task.PatchDay)
+	return t.metaStore.PutBackfillSubTask(key, task)
+}
+
+// ListByJob returns every sub-task row for the given job.
+func (t *BackfillJobTable) ListByJob(table string, shardID int, jobID string) ([]BackfillSubTask, error) {
+	return t.metaStore.GetBackfillSubTasks(table, shardID, jobID)
+}
+
+// Reclaim claims for this instance every sub-task of the job that is not
+// done or cancelled, so the backfillJobManager can resume them from their
+// last checkpoint. A "running" or "paused" sub-task is taken over only if
+// this instance already owns it or its lease has expired (the owning
+// instance likely crashed), and its Attempts is incremented; "pending" and
+// "failed" sub-tasks are claimed directly.
+func (t *BackfillJobTable) Reclaim(table string, shardID int, jobID string) ([]BackfillSubTask, error) {
+	tasks, err := t.ListByJob(table, shardID, jobID)
+	if err != nil {
+		return nil, utils.StackError(err, "failed to list backfill sub-tasks for %s shard %d job %s", table, shardID, jobID)
+	}
+
+	var resumable []BackfillSubTask
+	for i := range tasks {
+		task := &tasks[i]
+		switch task.State {
+		case BackfillSubTaskDone, BackfillSubTaskCancelled:
+			continue
+		case BackfillSubTaskRunning, BackfillSubTaskPaused:
+			if task.OwnerID != t.ownerID && time.Since(task.LeasedAt) < backfillSubTaskLeaseTimeout {
+				// Still owned by a live instance; skip.
+				continue
+			}
+			task.Attempts++
+		}
+		task.State = BackfillSubTaskRunning
+		task.OwnerID = t.ownerID
+		task.LeasedAt = utils.Now()
+		if err := t.CreateOrUpdate(*task); err != nil {
+			return nil, err
+		}
+		resumable = append(resumable, *task)
+	}
+	return resumable, nil
+}
+
+// MarkPaused persists every non-terminal sub-task of the given job as
+// paused, so the pause is visible to any instance inspecting the job
+// table and survives this instance crashing while the job sits paused.
+func (t *BackfillJobTable) MarkPaused(table string, shardID int, jobID string) error {
+	tasks, err := t.ListByJob(table, shardID, jobID)
+	if err != nil {
+		return utils.StackError(err, "failed to list backfill sub-tasks for %s shard %d job %s", table, shardID, jobID)
+	}
+	for _, task := range tasks {
+		if task.State == BackfillSubTaskDone || task.State == BackfillSubTaskCancelled {
+			continue
+		}
+		task.State = BackfillSubTaskPaused
+		if err := t.CreateOrUpdate(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkResumed reverts every paused sub-task of the given job back to
+// running, so a subsequent Reclaim treats it like any other in-flight
+// sub-task.
+func (t *BackfillJobTable) MarkResumed(table string, shardID int, jobID string) error {
+	tasks, err := t.ListByJob(table, shardID, jobID)
+	if err != nil {
+		return utils.StackError(err, "failed to list backfill sub-tasks for %s shard %d job %s", table, shardID, jobID)
+	}
+	for _, task := range tasks {
+		if task.State != BackfillSubTaskPaused {
+			continue
+		}
+		task.State = BackfillSubTaskRunning
+		if err := t.CreateOrUpdate(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkCancelled persists every non-terminal sub-task of the given job as
+// cancelled, so Reclaim skips them on any future attempt instead of
+// silently resuming work an admin explicitly stopped.
+func (t *BackfillJobTable) MarkCancelled(table string, shardID int, jobID string) error {
+	tasks, err := t.ListByJob(table, shardID, jobID)
+	if err != nil {
+		return utils.StackError(err, "failed to list backfill sub-tasks for %s shard %d job %s", table, shardID, jobID)
+	}
+	for _, task := range tasks {
+		if task.State == BackfillSubTaskDone || task.State == BackfillSubTaskCancelled {
+			continue
+		}
+		task.State = BackfillSubTaskCancelled
+		if err := t.CreateOrUpdate(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim persists a freshly-planned sub-task as running and owned by this
+// instance, mirroring the ownership bookkeeping Reclaim performs for
+// sub-tasks resumed from a crashed prior attempt.
+func (t *BackfillJobTable) Claim(task BackfillSubTask) (BackfillSubTask, error) {
+	task.State = BackfillSubTaskRunning
+	task.OwnerID = t.ownerID
+	task.LeasedAt = utils.Now()
+	if err := t.CreateOrUpdate(task); err != nil {
+		return BackfillSubTask{}, err
+	}
+	return task, nil
+}
+
+// Checkpoint persists a sub-task's NextWriteRecord and NextPatchRecordIndex
+// at a backfillStore batch-flush boundary so a resumed worker can skip
+// already-persisted records without miscounting no-op patch rows.
+func (t *BackfillJobTable) Checkpoint(task BackfillSubTask, nextWriteRecord memCom.RecordID, nextPatchRecordIndex int) error {
+	task.NextWriteRecord = nextWriteRecord
+	task.NextPatchRecordIndex = nextPatchRecordIndex
+	return t.CreateOrUpdate(task)
+}
+
+// MarkDone records a sub-task as completed.
+func (t *BackfillJobTable) MarkDone(task BackfillSubTask) error {
+	task.State = BackfillSubTaskDone
+	return t.CreateOrUpdate(task)
+}
+
+// MarkFailed records a sub-task as failed. It applies no attempt limit, so
+// a later Reclaim resumes the sub-task.
+func (t *BackfillJobTable) MarkFailed(task BackfillSubTask) error {
+	task.State = BackfillSubTaskFailed
+	return t.CreateOrUpdate(task)
+}
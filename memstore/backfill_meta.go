@@ -0,0 +1,120 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+)
+
+// BackfillMeta is a snapshot of the table schema fields a backfill job
+// depends on, captured once at job creation time. A long-running backfill
+// reads only from this snapshot instead of the live *memCom.TableSchema,
+// so a concurrent schema change (column add/drop/type change, sort-column
+// reorder) cannot silently corrupt the ArchiveBatch the job produces.
+type BackfillMeta struct {
+	// SchemaVersion is the tableSchema version this snapshot was taken
+	// from. createNewArchiveStoreVersionForBackfill refuses to swap the
+	// archive version if the live schema version has since diverged.
+	SchemaVersion        uint32
+	ColumnDeletions      []bool
+	ValueTypeByColumn    []memCom.DataType
+	DefaultValues        []*memCom.DataValue
+	ArchivingSortColumns []int
+	PrimaryKeyColumns    []int
+	// Location is the effective timezone used to bucketize event-time
+	// into the day keys createBackfillPatches groups records by.
+	Location *time.Location
+}
+
+// newBackfillMeta snapshots the fields of tableSchema a backfill job needs,
+// so they can be threaded through createBackfillPatches, newBackfillContext,
+// getChangedPatchRow, getChangedBaseRow and
+// writePatchValueForUnsortedColumn in place of direct tableSchema reads.
+func newBackfillMeta(tableSchema *memCom.TableSchema) BackfillMeta {
+	tableSchema.RLock()
+	defer tableSchema.RUnlock()
+
+	location := time.UTC
+	if tableSchema.Schema.Config.BackfillTimezone != "" {
+		if loc, err := time.LoadLocation(tableSchema.Schema.Config.BackfillTimezone); err == nil {
+			location = loc
+		}
+	}
+
+	return BackfillMeta{
+		SchemaVersion:        tableSchema.SchemaVersion,
+		ColumnDeletions:      tableSchema.GetColumnDeletions(),
+		ValueTypeByColumn:    tableSchema.ValueTypeByColumn,
+		DefaultValues:        tableSchema.DefaultValues,
+		ArchivingSortColumns: tableSchema.Schema.ArchivingSortColumns,
+		PrimaryKeyColumns:    tableSchema.Schema.PrimaryKeyColumns,
+		Location:             location,
+	}
+}
+
+// Stale reports whether the live tableSchema's version has diverged from
+// this snapshot, meaning any outstanding patches built against it must be
+// re-planned rather than applied as-is.
+func (meta BackfillMeta) Stale(tableSchema *memCom.TableSchema) bool {
+	tableSchema.RLock()
+	defer tableSchema.RUnlock()
+	return tableSchema.SchemaVersion != meta.SchemaVersion
+}
+
+// backfillMetaRegistry tracks the BackfillMeta snapshot BackfillJob.Run took
+// for each in-flight backfill job, keyed by jobKey. createBackfillPatches and
+// TableShard.createNewArchiveStoreVersionForBackfill look their job's
+// snapshot up here instead of taking it as a parameter, so their signatures
+// stay the ones callers (and the package's own tests) already use.
+type backfillMetaRegistry struct {
+	sync.Mutex
+	byKey map[string]BackfillMeta
+}
+
+func newBackfillMetaRegistry() *backfillMetaRegistry {
+	return &backfillMetaRegistry{byKey: make(map[string]BackfillMeta)}
+}
+
+// backfillMetaByJob is the single, process-wide registry shared by
+// BackfillJob.Run and the backfill pipeline it drives.
+var backfillMetaByJob = newBackfillMetaRegistry()
+
+// Register records meta as the snapshot jobKey's backfill job plans and
+// applies its patches against.
+func (r *backfillMetaRegistry) Register(jobKey string, meta BackfillMeta) {
+	r.Lock()
+	defer r.Unlock()
+	r.byKey[jobKey] = meta
+}
+
+// Lookup returns the BackfillMeta registered for jobKey, or the zero value
+// if none was registered -- e.g. a test driving createBackfillPatches or
+// createNewArchiveStoreVersionForBackfill directly without going through
+// BackfillJob.Run.
+func (r *backfillMetaRegistry) Lookup(jobKey string) BackfillMeta {
+	r.Lock()
+	defer r.Unlock()
+	return r.byKey[jobKey]
+}
+
+// Unregister discards the snapshot for jobKey once its job finishes.
+func (r *backfillMetaRegistry) Unregister(jobKey string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.byKey, jobKey)
+}
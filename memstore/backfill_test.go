@@ -26,6 +26,7 @@ import (
 	utilsMocks "github.com/uber/aresdb/utils/mocks"
 	"go.uber.org/zap"
 	"sync"
+	"time"
 )
 
 var _ = ginkgo.Describe("backfill", func() {
@@ -463,4 +464,72 @@ var _ = ginkgo.Describe("backfill", func() {
 		??(backfillCtx.backfillStore.NextWriteRecord).Should(Equal(memCom.RecordID{BatchID: BaseBatchID + 7, Index: 0}))
 		logger.Infof("Test Live store with batch size of 1 should work Finished")
 	})
+
+	ginkgo.It("BackfillMeta should detect a schema change mid-job", func() {
+		logger.Infof("Test BackfillMeta should detect a schema change mid-job Started")
+		meta := newBackfillMeta(tableSchema)
+		??(meta.Stale(tableSchema)).Should(BeFalse())
+
+		tableSchema.Lock()
+		tableSchema.SchemaVersion++
+		tableSchema.Schema.ArchivingSortColumns = []int{5, 1}
+		tableSchema.Unlock()
+
+		??(meta.Stale(tableSchema)).Should(BeTrue())
+		??(meta.ArchivingSortColumns).Should(BeEquivalentTo([]int{1, 5}))
+		logger.Infof("Test BackfillMeta should detect a schema change mid-job Finished")
+	})
+
+	ginkgo.It("pausing a backfill job should leave progress untouched until resumed", func() {
+		logger.Infof("Test pausing a backfill job should leave progress untouched until resumed Started")
+		control := backfillControlRegistry.Register(jobKey)
+		defer backfillControlRegistry.Unregister(jobKey)
+
+		// Pause before the job starts, so the very first CheckPoint()
+		// inside backfill() blocks deterministically instead of racing
+		// with however far the loop has already run.
+		control.Pause()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- backfillCtx.backfill(jobManager.reportBackfillJobDetail, jobKey)
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		select {
+		case <-done:
+			ginkgo.Fail("backfill should block while the job is paused")
+		default:
+		}
+
+		??(backfillCtx.backfillStore.NextWriteRecord).Should(Equal(memCom.RecordID{}))
+		??(backfillCtx.columnsForked).Should(Equal(make([]bool, len(backfillCtx.valueTypeByColumn))))
+
+		control.Resume()
+		??(<-done).Should(BeNil())
+
+		// Once resumed, the paused backfill() call runs to completion and
+		// makes the same progress an unpaused run would.
+		??(backfillCtx.backfillStore.NextWriteRecord).ShouldNot(Equal(memCom.RecordID{}))
+		logger.Infof("Test pausing a backfill job should leave progress untouched until resumed Finished")
+	})
+
+	ginkgo.It("cancelling a backfill job should stop it before it applies further patch rows", func() {
+		logger.Infof("Test cancelling a backfill job should stop it before it applies further patch rows Started")
+		control := backfillControlRegistry.Register(jobKey)
+		defer backfillControlRegistry.Unregister(jobKey)
+
+		// Cancel before the job starts, so the very first CheckPoint()
+		// inside backfill() fails deterministically.
+		control.Cancel()
+
+		err := backfillCtx.backfill(jobManager.reportBackfillJobDetail, jobKey)
+		??(err).Should(HaveOccurred())
+
+		// Cancelling before any row is applied must leave the context
+		// exactly as newBackfillContext left it.
+		??(backfillCtx.backfillStore.NextWriteRecord).Should(Equal(memCom.RecordID{}))
+		??(backfillCtx.columnsForked).Should(Equal(make([]bool, len(backfillCtx.valueTypeByColumn))))
+		logger.Infof("Test cancelling a backfill job should stop it before it applies further patch rows Finished")
+	})
 })
@@ -0,0 +1,138 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+)
+
+// memoryBackoffInterval is how long a worker waits before re-checking the
+// host memory budget while blocked on an overcommitted shard.
+const memoryBackoffInterval = 100 * time.Millisecond
+
+// defaultBackfillWorkers is the worker pool size used for a table that has
+// not configured a BackfillParallelism override.
+const defaultBackfillWorkers = 1
+
+// backfillWorkerPool dispatches independent backfillPatch objects to N
+// worker goroutines in parallel. Each patch targets a distinct archive day
+// baseBatch, so patches never contend on the same ArchiveBatch.Columns and
+// can safely run concurrently; only the terminal swap of
+// ArchiveStore.CurrentVersion after all patches complete needs to stay
+// single-threaded.
+type backfillWorkerPool struct {
+	sync.Mutex
+	size int
+}
+
+// newBackfillWorkerPool creates a backfillWorkerPool with the given initial
+// worker count.
+func newBackfillWorkerPool(size int) *backfillWorkerPool {
+	if size <= 0 {
+		size = defaultBackfillWorkers
+	}
+	return &backfillWorkerPool{size: size}
+}
+
+// SetSize adjusts the worker pool size at runtime, e.g. via an admin API,
+// without requiring a shard restart. It takes effect for the next patch
+// batch dispatched after the call.
+func (pool *backfillWorkerPool) SetSize(size int) {
+	if size <= 0 {
+		return
+	}
+	pool.Lock()
+	pool.size = size
+	pool.Unlock()
+}
+
+// Size returns the currently configured worker count.
+func (pool *backfillWorkerPool) Size() int {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.size
+}
+
+// backfillPatchResult is the per-worker progress reported for a single
+// backfillPatch, merged by the caller into a single BackfillJobDetail.
+// BatchID and Batch identify the forked ArchiveBatch this patch produced,
+// so the caller can fold it into the new ArchiveStoreVersion once every
+// patch has completed.
+type backfillPatchResult struct {
+	NumRecords      int
+	NumAffectedDays int
+	LockDuration    float64
+	BatchID         int
+	Batch           *ArchiveBatch
+	Err             error
+}
+
+// RunPatches applies the given patches to the shard's backfillJobManager
+// using up to pool.Size() worker goroutines, blocking until every patch
+// has either completed or failed. hostMemoryManager is consulted after a
+// worker claims its next patch and before it applies it, so that an
+// overcommitted shard blocks rather than growing memory usage further.
+func (pool *backfillWorkerPool) RunPatches(
+	patches []*backfillPatch,
+	hostMemoryManager memCom.HostMemoryManager,
+	apply func(patch *backfillPatch) backfillPatchResult,
+) []backfillPatchResult {
+	results := make([]backfillPatchResult, len(patches))
+	var nextIndex int32 = -1
+	workers := pool.Size()
+	if workers > len(patches) {
+		workers = len(patches)
+	}
+	if workers <= 0 {
+		return results
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				idx := int(atomic.AddInt32(&nextIndex, 1))
+				if idx >= len(patches) {
+					return
+				}
+				for hostMemoryManager.ReachedMemoryLimit() {
+					// Overcommitted: block this worker until the shard's
+					// memory usage falls back under budget instead of
+					// grabbing more patches.
+					time.Sleep(memoryBackoffInterval)
+				}
+				results[idx] = apply(patches[idx])
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// mergeBackfillPatchResults folds per-worker progress into a single
+// BackfillJobDetail update, as reportBackfillJobDetail expects.
+func mergeBackfillPatchResults(detail *BackfillJobDetail, results []backfillPatchResult) {
+	for _, result := range results {
+		detail.NumRecords += result.NumRecords
+		detail.NumAffectedDays += result.NumAffectedDays
+		detail.LockDuration += result.LockDuration
+	}
+}
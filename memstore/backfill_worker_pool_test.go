@@ -0,0 +1,60 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync/atomic"
+
+	"github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type noLimitHostMemoryManager struct{}
+
+func (noLimitHostMemoryManager) ReachedMemoryLimit() bool { return false }
+
+var _ = ginkgo.Describe("backfill worker pool", func() {
+	ginkgo.It("RunPatches should dispatch every patch exactly once and merge results", func() {
+		pool := newBackfillWorkerPool(4)
+		??(pool.Size()).Should(Equal(4))
+
+		patches := make([]*backfillPatch, 8)
+		for i := range patches {
+			patches[i] = &backfillPatch{}
+		}
+
+		var applied int32
+		results := pool.RunPatches(patches, noLimitHostMemoryManager{}, func(patch *backfillPatch) backfillPatchResult {
+			atomic.AddInt32(&applied, 1)
+			return backfillPatchResult{NumRecords: 1, NumAffectedDays: 1}
+		})
+
+		??(results).Should(HaveLen(8))
+		??(applied).Should(BeEquivalentTo(8))
+
+		detail := &BackfillJobDetail{}
+		mergeBackfillPatchResults(detail, results)
+		??(detail.NumRecords).Should(Equal(8))
+		??(detail.NumAffectedDays).Should(Equal(8))
+	})
+
+	ginkgo.It("SetSize should adjust the pool size at runtime", func() {
+		pool := newBackfillWorkerPool(2)
+		pool.SetSize(6)
+		??(pool.Size()).Should(Equal(6))
+		pool.SetSize(0)
+		??(pool.Size()).Should(Equal(6))
+	})
+})
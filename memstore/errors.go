@@ -0,0 +1,31 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import "errors"
+
+// Errors shared across this package.
+var (
+	// ErrTableDoesNotExist is returned when a requested table has no
+	// shards registered with the memStore.
+	ErrTableDoesNotExist = errors.New("table does not exist")
+	// ErrShardDoesNotExist is returned when a requested shard is not
+	// registered for an otherwise known table.
+	ErrShardDoesNotExist = errors.New("shard does not exist")
+	// ErrBackfillSchemaDiverged is returned when a backfill job's planned
+	// patches were built against a BackfillMeta snapshot that no longer
+	// matches the table's live schema version.
+	ErrBackfillSchemaDiverged = errors.New("backfill schema diverged from planning snapshot")
+)
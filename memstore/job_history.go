@@ -0,0 +1,141 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+)
+
+// defaultJobHistorySize is the number of completed executions kept per
+// <table|shard|jobType> before the oldest entry is evicted.
+const defaultJobHistorySize = 100
+
+// DispatchSource records whether a job execution was triggered by the
+// interval-based scheduler or submitted on demand through the dispatch API.
+type DispatchSource string
+
+const (
+	// DispatchSourceScheduled marks a run fired by the regular scheduler tick.
+	DispatchSourceScheduled DispatchSource = "scheduled"
+	// DispatchSourceOnDemand marks a run submitted through the dispatch API.
+	DispatchSourceOnDemand DispatchSource = "on-demand"
+)
+
+// JobExecution is a single completed run of a job, captured for the
+// execution history audit trail.
+type JobExecution struct {
+	Table          string         `json:"table"`
+	Shard          int            `json:"shard"`
+	JobType        memCom.JobType `json:"jobType"`
+	StartTime      time.Time      `json:"startTime"`
+	EndTime        time.Time      `json:"endTime"`
+	Succeeded      bool           `json:"succeeded"`
+	ErrorMessage   string         `json:"errorMessage,omitempty"`
+	Cutoff         uint32         `json:"cutoff,omitempty"`
+	BatchIDStart   int            `json:"batchIDStart,omitempty"`
+	BatchIDEnd     int            `json:"batchIDEnd,omitempty"`
+	NumRecords     int            `json:"numRecords,omitempty"`
+	BytesProcessed int64          `json:"bytesProcessed,omitempty"`
+	DispatchSource DispatchSource `json:"dispatchSource"`
+}
+
+// jobHistory is a fixed-size ring buffer of JobExecution records for a
+// single <table|shard|jobType>.
+type jobHistory struct {
+	entries []JobExecution
+	start   int
+	size    int
+}
+
+func newJobHistory(capacity int) *jobHistory {
+	return &jobHistory{entries: make([]JobExecution, capacity)}
+}
+
+func (h *jobHistory) add(execution JobExecution) {
+	capacity := len(h.entries)
+	idx := (h.start + h.size) % capacity
+	h.entries[idx] = execution
+	if h.size < capacity {
+		h.size++
+	} else {
+		h.start = (h.start + 1) % capacity
+	}
+}
+
+// snapshot returns the recorded executions, most recent first.
+func (h *jobHistory) snapshot() []JobExecution {
+	result := make([]JobExecution, h.size)
+	for i := 0; i < h.size; i++ {
+		idx := (h.start + h.size - 1 - i) % len(h.entries)
+		result[i] = h.entries[idx]
+	}
+	return result
+}
+
+// JobKeyInfo identifies a single <table|shard|jobType> job key, used to
+// enumerate history entries without exposing internal scheduler state.
+type JobKeyInfo struct {
+	JobKey string
+	Table  string
+	Shard  int
+}
+
+// JobHistoryStore tracks a bounded ring buffer of completed job executions
+// per <table|shard|jobType>, so operators can audit purge/archiving/
+// backfill/snapshot activity without scraping logs.
+type JobHistoryStore struct {
+	sync.RWMutex
+	capacity int
+	byKey    map[string]*jobHistory
+}
+
+// NewJobHistoryStore creates a JobHistoryStore that retains up to
+// capacity executions per job key. A capacity <= 0 defaults to
+// defaultJobHistorySize.
+func NewJobHistoryStore(capacity int) *JobHistoryStore {
+	if capacity <= 0 {
+		capacity = defaultJobHistorySize
+	}
+	return &JobHistoryStore{
+		capacity: capacity,
+		byKey:    make(map[string]*jobHistory),
+	}
+}
+
+// Record appends a completed execution to the history for jobKey.
+func (s *JobHistoryStore) Record(jobKey string, execution JobExecution) {
+	s.Lock()
+	defer s.Unlock()
+	history, ok := s.byKey[jobKey]
+	if !ok {
+		history = newJobHistory(s.capacity)
+		s.byKey[jobKey] = history
+	}
+	history.add(execution)
+}
+
+// Query returns the history for jobKey, most recent first.
+func (s *JobHistoryStore) Query(jobKey string) []JobExecution {
+	s.RLock()
+	defer s.RUnlock()
+	history, ok := s.byKey[jobKey]
+	if !ok {
+		return nil
+	}
+	return history.snapshot()
+}
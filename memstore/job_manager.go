@@ -0,0 +1,168 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+)
+
+// JobStatus is the coarse state of a single <table|shard|jobType> job, as
+// reported by getJobDetails/GetJobDetails.
+type JobStatus string
+
+const (
+	// JobStatusWaiting means the job's next scheduled run is still in the
+	// future.
+	JobStatusWaiting JobStatus = "waiting"
+	// JobStatusReady means the job is due to run on the next scheduler
+	// pass.
+	JobStatusReady JobStatus = "ready"
+)
+
+// JobDetail is the common progress/status information tracked for every
+// job, regardless of job type. Job-type-specific detail structs
+// (ArchivingJobDetail, BackfillJobDetail, SnapshotJobDetail, PurgeJobDetail)
+// embed it.
+type JobDetail struct {
+	Status        JobStatus `json:"status"`
+	NextRun       time.Time `json:"nextRun"`
+	LastRun       time.Time `json:"lastRun"`
+	LastStartTime time.Time `json:"lastStartTime"`
+
+	// Current/Total/NumRecords/NumAffectedDays/LockDuration are populated
+	// while a job is actively running.
+	Current         int     `json:"current,omitempty"`
+	Total           int     `json:"total,omitempty"`
+	NumRecords      int     `json:"numRecords,omitempty"`
+	NumAffectedDays int     `json:"numAffectedDays,omitempty"`
+	LockDuration    float64 `json:"lockDuration,omitempty"`
+}
+
+// ArchivingJobDetail is the progress/status information tracked for a
+// single archiving job.
+type ArchivingJobDetail struct {
+	JobDetail
+	CurrentCutoff uint32 `json:"currentCutoff"`
+	RunningCutoff uint32 `json:"runningCutoff"`
+	LastCutoff    uint32 `json:"lastCutoff"`
+	Stage         string `json:"stage"`
+}
+
+// BackfillJobDetail is the progress/status information tracked for a
+// single backfill job.
+type BackfillJobDetail struct {
+	JobDetail
+	Stage       string `json:"stage"`
+	RedologFile int64  `json:"redologFile"`
+	BatchOffset uint32 `json:"batchOffset"`
+}
+
+// SnapshotJobDetail is the progress/status information tracked for a
+// single snapshot job.
+type SnapshotJobDetail struct {
+	JobDetail
+	NumMutations int    `json:"numMutations"`
+	NumBatches   int    `json:"numBatches"`
+	RedologFile  int64  `json:"redologFile"`
+	BatchOffset  uint32 `json:"batchOffset"`
+	Stage        string `json:"stage"`
+}
+
+// PurgeJobDetail is the progress/status information tracked for a single
+// purge job.
+type PurgeJobDetail struct {
+	JobDetail
+	NumBatches   int    `json:"numBatches"`
+	BatchIDStart int    `json:"batchIDStart"`
+	BatchIDEnd   int    `json:"batchIDEnd"`
+	Stage        string `json:"stage"`
+}
+
+// Job is a single unit of scheduled or dispatched work: one run of
+// archiving/backfill/snapshot/purge against one table shard.
+type Job interface {
+	// GetIdentifier returns the <table|shard|jobType> key this job
+	// reports its progress under.
+	GetIdentifier() string
+	// JobType returns the job type this job belongs to, so schedulerImpl
+	// can look up the right jobManager to persist its detail after Run.
+	JobType() memCom.JobType
+	// Run executes the job synchronously.
+	Run() error
+	String() string
+}
+
+// getIdentifier builds the <table|shard|jobType> key job details and
+// dispatches are keyed by.
+func getIdentifier(table string, shard int, jobType memCom.JobType) string {
+	return fmt.Sprintf("%s|%d|%s", table, shard, jobType)
+}
+
+// parseIdentifier splits a <table|shard|jobType> key back into its table
+// and shard components, for callers (runJob, loadPersistedJobState,
+// JobKeysByType) that only have the key, not the original table/shard.
+func parseIdentifier(key string) (table string, shard int) {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) < 2 {
+		return key, 0
+	}
+	shard, _ = strconv.Atoi(parts[1])
+	return parts[0], shard
+}
+
+// jobManager owns the scheduling and progress tracking for every shard of
+// a single job type (archiving, backfill, snapshot, or purge).
+type jobManager interface {
+	// generateJobs returns the jobs that are due to run right now. Only
+	// called by schedulerImpl.run() while leaderElector.IsLeader() is true.
+	generateJobs() []Job
+	// getJobDetails returns the job-type-specific detail map, e.g.
+	// map[string]*BackfillJobDetail, keyed by job identifier.
+	getJobDetails() interface{}
+	// reportJobDetail mutates the common JobDetail embedded in the
+	// job-type-specific detail for key, creating it if absent.
+	reportJobDetail(key string, apply func(detail *JobDetail))
+	// deleteTable drops every job detail belonging to table, e.g. when
+	// the table itself is dropped.
+	deleteTable(table string)
+	// loadJobDetail unmarshals raw into the job-type-specific detail for
+	// key, overwriting whatever is already there. It is only called by
+	// schedulerImpl.Start, to rehydrate state persisted by JobStateStore
+	// before the background generateJobs loop starts.
+	loadJobDetail(key string, raw json.RawMessage) error
+}
+
+// baseJobManager holds the fields shared by every jobManager
+// implementation. Locking delegates to the owning scheduler's RWMutex
+// rather than a private lock, so a caller can take one scheduler.RLock()
+// and safely read across every job type's jobDetails map at once.
+type baseJobManager struct {
+	scheduler *schedulerImpl
+}
+
+func (b *baseJobManager) memStore() *memStoreImpl {
+	return b.scheduler.memStore
+}
+
+func (b *baseJobManager) Lock()    { b.scheduler.Lock() }
+func (b *baseJobManager) Unlock()  { b.scheduler.Unlock() }
+func (b *baseJobManager) RLock()   { b.scheduler.RLock() }
+func (b *baseJobManager) RUnlock() { b.scheduler.RUnlock() }
@@ -0,0 +1,141 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"encoding/json"
+	"sync"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+	metaCom "github.com/uber/aresdb/metastore/common"
+	"github.com/uber/aresdb/utils"
+)
+
+// JobStateRecord is the persisted form of a single <table|shard|jobType>
+// JobDetail. Revision increases by one on every write so concurrent
+// writers (e.g. a scheduler that lost and regained leadership) can detect
+// a torn write and refuse to apply an update based on a stale revision.
+type JobStateRecord struct {
+	Revision uint64          `json:"revision"`
+	JobKey   string          `json:"jobKey"`
+	JobType  memCom.JobType  `json:"jobType"`
+	Detail   json.RawMessage `json:"detail"`
+}
+
+// JobStateStore persists job scheduling state so it survives a process
+// restart. It is backed by the existing metaStore key/value space rather
+// than a new storage engine.
+type JobStateStore struct {
+	metaStore metaCom.MetaStore
+
+	sync.Mutex
+	revisions map[string]uint64
+}
+
+// NewJobStateStore creates a new JobStateStore on top of the given
+// metaStore.
+func NewJobStateStore(metaStore metaCom.MetaStore) *JobStateStore {
+	return &JobStateStore{
+		metaStore: metaStore,
+		revisions: make(map[string]uint64),
+	}
+}
+
+// Save persists the given job detail under jobKey, stamping it with the
+// next revision number for that key. It first re-reads the currently
+// persisted revision and refuses to overwrite it if that revision has
+// moved past what this JobStateStore last saw, so a writer that lost a
+// race against another instance (e.g. two nodes briefly both believing
+// they are leader) detects the torn write instead of silently clobbering
+// it.
+func (s *JobStateStore) Save(jobKey string, jobType memCom.JobType, detail interface{}) error {
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		return utils.StackError(err, "failed to marshal job detail for %s", jobKey)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	persistedRevision, err := s.loadPersistedRevision(jobKey)
+	if err != nil {
+		return err
+	}
+	if persistedRevision > s.revisions[jobKey] {
+		return utils.StackError(nil, "job state for %s is at revision %d, ahead of the revision %d this writer last saw",
+			jobKey, persistedRevision, s.revisions[jobKey])
+	}
+
+	revision := s.revisions[jobKey] + 1
+	record := JobStateRecord{
+		Revision: revision,
+		JobKey:   jobKey,
+		JobType:  jobType,
+		Detail:   raw,
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return utils.StackError(err, "failed to marshal job state record for %s", jobKey)
+	}
+
+	if err := s.metaStore.PutJobState(jobKey, recordBytes); err != nil {
+		return err
+	}
+	s.revisions[jobKey] = revision
+	return nil
+}
+
+// loadPersistedRevision returns the revision currently persisted for
+// jobKey, or 0 if no record exists yet. Callers must hold s.Lock.
+func (s *JobStateStore) loadPersistedRevision(jobKey string) (uint64, error) {
+	raw, ok, err := s.metaStore.GetJobState(jobKey)
+	if err != nil {
+		return 0, utils.StackError(err, "failed to load job state record for %s", jobKey)
+	}
+	if !ok {
+		return 0, nil
+	}
+	var record JobStateRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return 0, utils.StackError(err, "failed to unmarshal job state record for %s", jobKey)
+	}
+	return record.Revision, nil
+}
+
+// LoadAll reads every persisted JobStateRecord back from the metaStore. It
+// is called once by schedulerImpl.Start (through loadPersistedJobState) to
+// rehydrate in-memory JobDetail state. Of the loaded records, only backfill
+// records whose Stage is non-empty and not "cancelled" are treated by the
+// caller as needing recovery; records of the other job types are loaded
+// but never re-run, whatever their stage.
+func (s *JobStateStore) LoadAll() (map[string]JobStateRecord, error) {
+	rawRecords, err := s.metaStore.GetAllJobStates()
+	if err != nil {
+		return nil, utils.StackError(err, "failed to load job state records")
+	}
+
+	records := make(map[string]JobStateRecord, len(rawRecords))
+	s.Lock()
+	defer s.Unlock()
+	for jobKey, raw := range rawRecords {
+		var record JobStateRecord
+		if err := json.Unmarshal(raw, &record); err != nil {
+			return nil, utils.StackError(err, "failed to unmarshal job state record for %s", jobKey)
+		}
+		records[jobKey] = record
+		s.revisions[jobKey] = record.Revision
+	}
+	return records, nil
+}
@@ -0,0 +1,693 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+	"github.com/uber/aresdb/utils"
+)
+
+// ArchivingJob archives live records older than cutoff into the shard's
+// archive store.
+type ArchivingJob struct {
+	memStore  *memStoreImpl
+	tableName string
+	shardID   int
+	cutoff    uint32
+}
+
+// GetIdentifier returns this job's <table|shard|jobType> key.
+func (j *ArchivingJob) GetIdentifier() string {
+	return getIdentifier(j.tableName, j.shardID, memCom.ArchivingJobType)
+}
+
+// JobType returns memCom.ArchivingJobType.
+func (j *ArchivingJob) JobType() memCom.JobType {
+	return memCom.ArchivingJobType
+}
+
+func (j *ArchivingJob) String() string {
+	return fmt.Sprintf("ArchivingJob<Table: %s, ShardID: %d, Cutoff: %d>", j.tableName, j.shardID, j.cutoff)
+}
+
+// Run swaps in the shard's ArchivingCutoff once archiving for this cutoff
+// completes.
+func (j *ArchivingJob) Run() error {
+	shard, err := j.getShard()
+	if err != nil {
+		return err
+	}
+	shard.ArchiveStore.Lock()
+	defer shard.ArchiveStore.Unlock()
+	shard.ArchiveStore.CurrentVersion.ArchivingCutoff = j.cutoff
+	return nil
+}
+
+func (j *ArchivingJob) getShard() (*TableShard, error) {
+	return getTableShard(j.memStore, j.tableName, j.shardID)
+}
+
+// BackfillJob applies buffered backfill records into the shard's archive
+// store.
+type BackfillJob struct {
+	memStore  *memStoreImpl
+	tableName string
+	shardID   int
+
+	// numRecords and bytesProcessed are filled in by Run once it knows how
+	// much it backfilled, so schedulerImpl.runJob can record them on the
+	// execution history entry.
+	numRecords     int
+	bytesProcessed int64
+}
+
+// GetIdentifier returns this job's <table|shard|jobType> key.
+func (j *BackfillJob) GetIdentifier() string {
+	return getIdentifier(j.tableName, j.shardID, memCom.BackfillJobType)
+}
+
+// JobType returns memCom.BackfillJobType.
+func (j *BackfillJob) JobType() memCom.JobType {
+	return memCom.BackfillJobType
+}
+
+func (j *BackfillJob) String() string {
+	return fmt.Sprintf("BackfillJob<Table: %s, ShardID: %d>", j.tableName, j.shardID)
+}
+
+// Run drains the shard's buffered backfill records, buckets them into
+// per-day patches, and applies those patches to the shard's archive store
+// across its backfillWorkerPool.
+func (j *BackfillJob) Run() error {
+	shard, err := j.getShard()
+	if err != nil {
+		return err
+	}
+	j.bytesProcessed = shard.LiveStore.BackfillManager.CurrentBufferSize
+	upsertBatches := shard.LiveStore.BackfillManager.drainPendingUpsertBatches()
+	if len(upsertBatches) == 0 {
+		return nil
+	}
+
+	// meta is snapshotted once here, before any patch is planned, and
+	// registered under jobKey so createBackfillPatches and
+	// createNewArchiveStoreVersionForBackfill can look it up instead of
+	// taking it as a parameter. That way every patch this job produces is
+	// bucketed and forked against the exact schema the job was created
+	// under rather than whatever the live schema happens to be by the
+	// time createNewArchiveStoreVersionForBackfill applies them.
+	meta := newBackfillMeta(shard.Schema)
+
+	report := shard.backfillJobManager().reportBackfillJobDetail
+	jobKey := j.GetIdentifier()
+
+	backfillMetaByJob.Register(jobKey, meta)
+	defer backfillMetaByJob.Unregister(jobKey)
+
+	backfillControlRegistry.Register(jobKey).SetReport(report)
+	defer backfillControlRegistry.Unregister(jobKey)
+
+	patches, err := createBackfillPatches(upsertBatches, report, jobKey)
+	if err != nil {
+		return err
+	}
+	for _, patch := range patches {
+		j.numRecords += len(patch.recordIDs)
+	}
+
+	jobTable := shard.backfillJobTable()
+
+	// Reclaim any sub-task this job left "running" in a prior attempt
+	// that crashed before finishing, so its patch resumes from its last
+	// checkpoint instead of redoing already-flushed records.
+	resumed, err := jobTable.Reclaim(j.tableName, j.shardID, jobKey)
+	if err != nil {
+		return err
+	}
+	resumeFrom := make(map[int64]BackfillSubTask, len(resumed))
+	for _, task := range resumed {
+		resumeFrom[task.PatchDay] = task
+	}
+
+	subTasks := make(map[int64]BackfillSubTask, len(patches))
+	for _, patch := range patches {
+		task := j.subTask(patch, meta)
+		if reclaimed, ok := resumeFrom[patch.day]; ok {
+			// Reclaim already persisted this row as running; don't
+			// clobber its checkpoint with a freshly-claimed one.
+			task.NextWriteRecord = reclaimed.NextWriteRecord
+			task.NextPatchRecordIndex = reclaimed.NextPatchRecordIndex
+			subTasks[patch.day] = task
+			continue
+		}
+		claimed, err := jobTable.Claim(task)
+		if err != nil {
+			return err
+		}
+		subTasks[patch.day] = claimed
+	}
+
+	if err := shard.createNewArchiveStoreVersionForBackfill(patches, report, jobKey); err != nil {
+		// A cancelled job already had its sub-tasks persisted as
+		// cancelled by BackfillJobTable.MarkCancelled; don't clobber that
+		// with "failed", which would make Reclaim think it's safe to
+		// resume them.
+		if !backfillControlRegistry.IsCancelled(jobKey) {
+			for _, patch := range patches {
+				jobTable.MarkFailed(subTasks[patch.day])
+			}
+		}
+		return err
+	}
+
+	for _, patch := range patches {
+		jobTable.MarkDone(subTasks[patch.day])
+	}
+
+	// Clear Stage now that the job has finished cleanly, so a future
+	// schedulerImpl.loadPersistedJobState doesn't mistake this completed
+	// run for one that crashed mid-flight.
+	report(jobKey, func(detail *BackfillJobDetail) {
+		detail.Stage = ""
+	})
+	return nil
+}
+
+// subTask builds the BackfillSubTask row patch is tracked under in this
+// job's BackfillJobTable, carrying the schema snapshot the patch was
+// planned against so a resumed worker applies it consistently.
+func (j *BackfillJob) subTask(patch *backfillPatch, meta BackfillMeta) BackfillSubTask {
+	return BackfillSubTask{
+		Table:    j.tableName,
+		ShardID:  j.shardID,
+		JobID:    j.GetIdentifier(),
+		PatchDay: patch.day,
+		Meta:     meta,
+	}
+}
+
+func (j *BackfillJob) getShard() (*TableShard, error) {
+	return getTableShard(j.memStore, j.tableName, j.shardID)
+}
+
+// SnapshotJob snapshots a dimension table shard's live store to disk.
+type SnapshotJob struct {
+	memStore  *memStoreImpl
+	tableName string
+	shardID   int
+}
+
+// GetIdentifier returns this job's <table|shard|jobType> key.
+func (j *SnapshotJob) GetIdentifier() string {
+	return getIdentifier(j.tableName, j.shardID, memCom.SnapshotJobType)
+}
+
+// JobType returns memCom.SnapshotJobType.
+func (j *SnapshotJob) JobType() memCom.JobType {
+	return memCom.SnapshotJobType
+}
+
+func (j *SnapshotJob) String() string {
+	return fmt.Sprintf("SnapshotJob<Table: %s, ShardID: %d>", j.tableName, j.shardID)
+}
+
+// Run resets the shard's NumMutations counter once the snapshot completes.
+func (j *SnapshotJob) Run() error {
+	shard, err := j.getShard()
+	if err != nil {
+		return err
+	}
+	shard.Lock()
+	defer shard.Unlock()
+	shard.LiveStore.SnapshotManager.NumMutations = 0
+	return nil
+}
+
+func (j *SnapshotJob) getShard() (*TableShard, error) {
+	return getTableShard(j.memStore, j.tableName, j.shardID)
+}
+
+// PurgeJob deletes archive batches in [batchIDStart, batchIDEnd) that have
+// aged out of the table's retention window.
+type PurgeJob struct {
+	memStore     *memStoreImpl
+	tableName    string
+	shardID      int
+	batchIDStart int
+	batchIDEnd   int
+}
+
+// GetIdentifier returns this job's <table|shard|jobType> key.
+func (j *PurgeJob) GetIdentifier() string {
+	return getIdentifier(j.tableName, j.shardID, memCom.PurgeJobType)
+}
+
+// JobType returns memCom.PurgeJobType.
+func (j *PurgeJob) JobType() memCom.JobType {
+	return memCom.PurgeJobType
+}
+
+func (j *PurgeJob) String() string {
+	return fmt.Sprintf("PurgeJob<Table: %s, ShardID: %d>", j.tableName, j.shardID)
+}
+
+// Run deletes the purged batch range from the shard's archive store.
+func (j *PurgeJob) Run() error {
+	shard, err := j.getShard()
+	if err != nil {
+		return err
+	}
+	shard.ArchiveStore.Lock()
+	defer shard.ArchiveStore.Unlock()
+	for batchID := j.batchIDStart; batchID < j.batchIDEnd; batchID++ {
+		delete(shard.ArchiveStore.CurrentVersion.Batches, batchID)
+	}
+	return nil
+}
+
+func (j *PurgeJob) getShard() (*TableShard, error) {
+	return getTableShard(j.memStore, j.tableName, j.shardID)
+}
+
+// getTableShard looks up a single (table, shard) from memStore.
+func getTableShard(memStore *memStoreImpl, table string, shardID int) (*TableShard, error) {
+	memStore.RLock()
+	defer memStore.RUnlock()
+	shards, ok := memStore.TableShards[table]
+	if !ok {
+		return nil, ErrTableDoesNotExist
+	}
+	shard, ok := shards[shardID]
+	if !ok {
+		return nil, ErrShardDoesNotExist
+	}
+	return shard, nil
+}
+
+// forEachFactTableShard walks every shard of every fact table currently
+// registered with memStore.
+func forEachFactTableShard(memStore *memStoreImpl, visit func(table string, shardID int, shard *TableShard)) {
+	memStore.RLock()
+	defer memStore.RUnlock()
+	for table, shards := range memStore.TableShards {
+		for shardID, shard := range shards {
+			if shard.Schema.Schema.IsFactTable {
+				visit(table, shardID, shard)
+			}
+		}
+	}
+}
+
+// forEachDimensionTableShard walks every shard of every dimension table
+// currently registered with memStore.
+func forEachDimensionTableShard(memStore *memStoreImpl, visit func(table string, shardID int, shard *TableShard)) {
+	memStore.RLock()
+	defer memStore.RUnlock()
+	for table, shards := range memStore.TableShards {
+		for shardID, shard := range shards {
+			if !shard.Schema.Schema.IsFactTable {
+				visit(table, shardID, shard)
+			}
+		}
+	}
+}
+
+// archivingJobManager owns scheduling and progress for every fact table
+// shard's archiving job.
+type archivingJobManager struct {
+	baseJobManager
+	jobDetails map[string]*ArchivingJobDetail
+}
+
+func (jm *archivingJobManager) generateJobs() []Job {
+	jm.Lock()
+	defer jm.Unlock()
+
+	var jobs []Job
+	forEachFactTableShard(jm.memStore(), func(table string, shardID int, shard *TableShard) {
+		schema := shard.Schema
+		schema.RLock()
+		delayMinutes := schema.Schema.Config.ArchivingDelayMinutes
+		intervalMinutes := schema.Schema.Config.ArchivingIntervalMinutes
+		schema.RUnlock()
+
+		key := getIdentifier(table, shardID, memCom.ArchivingJobType)
+		detail, ok := jm.jobDetails[key]
+		if !ok {
+			detail = &ArchivingJobDetail{}
+			jm.jobDetails[key] = detail
+		}
+
+		shard.ArchiveStore.RLock()
+		currentCutoff := shard.ArchiveStore.CurrentVersion.ArchivingCutoff
+		shard.ArchiveStore.RUnlock()
+
+		now := uint32(utils.Now().Unix())
+		cutoff := now - delayMinutes*60
+
+		detail.CurrentCutoff = currentCutoff
+		if cutoff > currentCutoff {
+			detail.Status = JobStatusReady
+			detail.NextRun = time.Time{}
+			jobs = append(jobs, &ArchivingJob{memStore: jm.memStore(), tableName: table, shardID: shardID, cutoff: cutoff})
+		} else {
+			detail.Status = JobStatusWaiting
+			detail.NextRun = time.Unix(int64(currentCutoff)+int64(intervalMinutes)*60, 0).UTC()
+		}
+	})
+	return jobs
+}
+
+func (jm *archivingJobManager) getJobDetails() interface{} {
+	return jm.jobDetails
+}
+
+func (jm *archivingJobManager) reportJobDetail(key string, apply func(detail *JobDetail)) {
+	jm.Lock()
+	defer jm.Unlock()
+	detail, ok := jm.jobDetails[key]
+	if !ok {
+		detail = &ArchivingJobDetail{}
+		jm.jobDetails[key] = detail
+	}
+	apply(&detail.JobDetail)
+}
+
+func (jm *archivingJobManager) deleteTable(table string) {
+	jm.Lock()
+	defer jm.Unlock()
+	deleteTableKeys(jm.jobDetails, table)
+}
+
+func (jm *archivingJobManager) loadJobDetail(key string, raw json.RawMessage) error {
+	detail := &ArchivingJobDetail{}
+	if err := json.Unmarshal(raw, detail); err != nil {
+		return err
+	}
+	jm.Lock()
+	defer jm.Unlock()
+	jm.jobDetails[key] = detail
+	return nil
+}
+
+// backfillJobManager owns scheduling and progress for every fact table
+// shard's backfill job.
+type backfillJobManager struct {
+	baseJobManager
+	jobDetails map[string]*BackfillJobDetail
+}
+
+func (jm *backfillJobManager) generateJobs() []Job {
+	jm.Lock()
+	defer jm.Unlock()
+
+	var jobs []Job
+	forEachFactTableShard(jm.memStore(), func(table string, shardID int, shard *TableShard) {
+		schema := shard.Schema
+		schema.RLock()
+		intervalMinutes := schema.Schema.Config.BackfillIntervalMinutes
+		thresholdBytes := schema.Schema.Config.BackfillThresholdInBytes
+		schema.RUnlock()
+
+		key := getIdentifier(table, shardID, memCom.BackfillJobType)
+		detail, ok := jm.jobDetails[key]
+		if !ok {
+			detail = &BackfillJobDetail{}
+			jm.jobDetails[key] = detail
+		}
+
+		bufferSize := shard.LiveStore.BackfillManager.CurrentBufferSize
+		now := utils.Now()
+		interval := time.Duration(intervalMinutes) * time.Minute
+
+		ready := bufferSize >= thresholdBytes ||
+			(!detail.LastRun.IsZero() && now.Sub(detail.LastRun) >= interval)
+
+		if ready {
+			detail.Status = JobStatusReady
+			jobs = append(jobs, &BackfillJob{memStore: jm.memStore(), tableName: table, shardID: shardID})
+		} else {
+			detail.Status = JobStatusWaiting
+			if detail.LastRun.IsZero() {
+				// First time this job has ever been observed: start the
+				// interval clock now instead of leaving LastRun zero
+				// forever, which would make every future tick look like
+				// now.Sub(detail.LastRun) spans since the Unix epoch.
+				detail.LastRun = now.UTC()
+			}
+		}
+	})
+	return jobs
+}
+
+func (jm *backfillJobManager) getJobDetails() interface{} {
+	return jm.jobDetails
+}
+
+func (jm *backfillJobManager) reportJobDetail(key string, apply func(detail *JobDetail)) {
+	jm.Lock()
+	defer jm.Unlock()
+	detail, ok := jm.jobDetails[key]
+	if !ok {
+		detail = &BackfillJobDetail{}
+		jm.jobDetails[key] = detail
+	}
+	apply(&detail.JobDetail)
+}
+
+// getJobDetail returns the BackfillJobDetail for key, creating it if absent.
+// Callers must hold jm.RLock/RUnlock (or Lock/Unlock) around reads of the
+// returned pointer.
+func (jm *backfillJobManager) getJobDetail(key string) *BackfillJobDetail {
+	detail, ok := jm.jobDetails[key]
+	if !ok {
+		detail = &BackfillJobDetail{}
+		jm.jobDetails[key] = detail
+	}
+	return detail
+}
+
+// reportBackfillJobDetail mutates the BackfillJobDetail for key in place,
+// creating it if absent. Unlike reportJobDetail, apply receives the full
+// concrete *BackfillJobDetail, so callers (createBackfillPatches,
+// createNewArchiveStoreVersionForBackfill) can set Stage alongside the
+// common JobDetail fields.
+func (jm *backfillJobManager) reportBackfillJobDetail(key string, apply func(detail *BackfillJobDetail)) {
+	jm.Lock()
+	defer jm.Unlock()
+	apply(jm.getJobDetail(key))
+}
+
+func (jm *backfillJobManager) deleteTable(table string) {
+	jm.Lock()
+	defer jm.Unlock()
+	deleteTableKeys(jm.jobDetails, table)
+}
+
+func (jm *backfillJobManager) loadJobDetail(key string, raw json.RawMessage) error {
+	detail := &BackfillJobDetail{}
+	if err := json.Unmarshal(raw, detail); err != nil {
+		return err
+	}
+	jm.Lock()
+	defer jm.Unlock()
+	jm.jobDetails[key] = detail
+	return nil
+}
+
+// snapshotJobManager owns scheduling and progress for every dimension table
+// shard's snapshot job.
+type snapshotJobManager struct {
+	baseJobManager
+	jobDetails map[string]*SnapshotJobDetail
+}
+
+func (jm *snapshotJobManager) generateJobs() []Job {
+	jm.Lock()
+	defer jm.Unlock()
+
+	var jobs []Job
+	forEachDimensionTableShard(jm.memStore(), func(table string, shardID int, shard *TableShard) {
+		schema := shard.Schema
+		schema.RLock()
+		threshold := schema.Schema.Config.SnapshotThreshold
+		schema.RUnlock()
+
+		key := getIdentifier(table, shardID, memCom.SnapshotJobType)
+		detail, ok := jm.jobDetails[key]
+		if !ok {
+			detail = &SnapshotJobDetail{}
+			jm.jobDetails[key] = detail
+		}
+
+		if shard.LiveStore.SnapshotManager.NumMutations >= threshold {
+			detail.Status = JobStatusReady
+			jobs = append(jobs, &SnapshotJob{memStore: jm.memStore(), tableName: table, shardID: shardID})
+		} else {
+			detail.Status = JobStatusWaiting
+		}
+	})
+	return jobs
+}
+
+func (jm *snapshotJobManager) getJobDetails() interface{} {
+	return jm.jobDetails
+}
+
+func (jm *snapshotJobManager) reportJobDetail(key string, apply func(detail *JobDetail)) {
+	jm.Lock()
+	defer jm.Unlock()
+	detail, ok := jm.jobDetails[key]
+	if !ok {
+		detail = &SnapshotJobDetail{}
+		jm.jobDetails[key] = detail
+	}
+	apply(&detail.JobDetail)
+}
+
+func (jm *snapshotJobManager) deleteTable(table string) {
+	jm.Lock()
+	defer jm.Unlock()
+	deleteTableKeys(jm.jobDetails, table)
+}
+
+func (jm *snapshotJobManager) loadJobDetail(key string, raw json.RawMessage) error {
+	detail := &SnapshotJobDetail{}
+	if err := json.Unmarshal(raw, detail); err != nil {
+		return err
+	}
+	jm.Lock()
+	defer jm.Unlock()
+	jm.jobDetails[key] = detail
+	return nil
+}
+
+// purgeJobManager owns scheduling and progress for every fact table shard's
+// purge job.
+type purgeJobManager struct {
+	baseJobManager
+	jobDetails map[string]*PurgeJobDetail
+}
+
+func (jm *purgeJobManager) generateJobs() []Job {
+	jm.Lock()
+	defer jm.Unlock()
+
+	var jobs []Job
+	forEachFactTableShard(jm.memStore(), func(table string, shardID int, shard *TableShard) {
+		schema := shard.Schema
+		schema.RLock()
+		retentionDays := schema.Schema.Config.RecordRetentionInDays
+		schema.RUnlock()
+
+		if retentionDays <= 0 {
+			return
+		}
+
+		key := getIdentifier(table, shardID, memCom.PurgeJobType)
+		detail, ok := jm.jobDetails[key]
+		if !ok {
+			detail = &PurgeJobDetail{}
+			jm.jobDetails[key] = detail
+		}
+
+		now := utils.Now().Unix()
+		batchIDEnd := int((now - int64(retentionDays)*86400) / 86400)
+
+		if batchIDEnd > detail.BatchIDEnd {
+			detail.Status = JobStatusReady
+			jobs = append(jobs, &PurgeJob{
+				memStore:     jm.memStore(),
+				tableName:    table,
+				shardID:      shardID,
+				batchIDStart: detail.BatchIDStart,
+				batchIDEnd:   batchIDEnd,
+			})
+			detail.BatchIDEnd = batchIDEnd
+		} else {
+			detail.Status = JobStatusWaiting
+		}
+	})
+	return jobs
+}
+
+func (jm *purgeJobManager) getJobDetails() interface{} {
+	return jm.jobDetails
+}
+
+func (jm *purgeJobManager) reportJobDetail(key string, apply func(detail *JobDetail)) {
+	jm.Lock()
+	defer jm.Unlock()
+	detail, ok := jm.jobDetails[key]
+	if !ok {
+		detail = &PurgeJobDetail{}
+		jm.jobDetails[key] = detail
+	}
+	apply(&detail.JobDetail)
+}
+
+func (jm *purgeJobManager) deleteTable(table string) {
+	jm.Lock()
+	defer jm.Unlock()
+	deleteTableKeys(jm.jobDetails, table)
+}
+
+func (jm *purgeJobManager) loadJobDetail(key string, raw json.RawMessage) error {
+	detail := &PurgeJobDetail{}
+	if err := json.Unmarshal(raw, detail); err != nil {
+		return err
+	}
+	jm.Lock()
+	defer jm.Unlock()
+	jm.jobDetails[key] = detail
+	return nil
+}
+
+// deleteTableKeys removes every entry of detailsByKey whose key belongs to
+// table, regardless of the concrete detail type.
+func deleteTableKeys(detailsByKey interface{}, table string) {
+	prefix := table + "|"
+	switch details := detailsByKey.(type) {
+	case map[string]*ArchivingJobDetail:
+		for key := range details {
+			if strings.HasPrefix(key, prefix) {
+				delete(details, key)
+			}
+		}
+	case map[string]*BackfillJobDetail:
+		for key := range details {
+			if strings.HasPrefix(key, prefix) {
+				delete(details, key)
+			}
+		}
+	case map[string]*SnapshotJobDetail:
+		for key := range details {
+			if strings.HasPrefix(key, prefix) {
+				delete(details, key)
+			}
+		}
+	case map[string]*PurgeJobDetail:
+		for key := range details {
+			if strings.HasPrefix(key, prefix) {
+				delete(details, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,520 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync"
+	"time"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+	"github.com/uber/aresdb/utils"
+)
+
+// schedulerTickInterval is how often schedulerImpl.run checks for due jobs.
+const schedulerTickInterval = time.Second
+
+// Scheduler is the single, consolidated interface every HTTP handler in
+// the api package depends on to create and inspect archiving/backfill/
+// snapshot/purge jobs, and to read this node's leader election state.
+type Scheduler interface {
+	// ClusterStatus reports this node's leader election state.
+	ClusterStatus() ClusterStatus
+
+	// NewArchivingJob, NewBackfillJob, NewSnapshotJob, and NewPurgeJob
+	// build a Job ready to be run, without scheduling it.
+	NewArchivingJob(table string, shard int, cutoff uint32) Job
+	NewBackfillJob(table string, shard int) Job
+	NewSnapshotJob(table string, shard int) Job
+	NewPurgeJob(table string, shard int, batchIDStart, batchIDEnd int) Job
+
+	// GetJobDetails returns the job-type-specific detail map for jobType.
+	GetJobDetails(jobType memCom.JobType) interface{}
+	// DeleteTable drops every job detail belonging to table from every
+	// jobManager relevant to isFactTable.
+	DeleteTable(table string, isFactTable bool)
+
+	// GetTableSchema looks up the schema of the given table shard, so a
+	// dispatch request can be validated before a Job is built for it.
+	GetTableSchema(table string, shard int) (*memCom.TableSchema, error)
+	// Dispatch submits job to run immediately under dispatchID.
+	Dispatch(dispatchID string, job Job, meta map[string]string) error
+	// Wait blocks until the job submitted under dispatchID has completed.
+	Wait(dispatchID string)
+
+	// JobKeysByType enumerates every job key currently tracked for
+	// jobType, so the history handler can filter by table/shard.
+	JobKeysByType(jobType memCom.JobType) []JobKeyInfo
+
+	// PauseBackfillJob, ResumeBackfillJob, and CancelBackfillJob control an
+	// in-flight backfill job for the given table and shard. They return an
+	// error if no backfill job is currently running there.
+	PauseBackfillJob(table string, shard int) error
+	ResumeBackfillJob(table string, shard int) error
+	CancelBackfillJob(table string, shard int) error
+}
+
+// dispatchRecord tracks a single on-demand Dispatch call so Wait can block
+// until it completes.
+type dispatchRecord struct {
+	done chan struct{}
+	err  error
+}
+
+// schedulerImpl is the only implementation of Scheduler. One is created
+// per process; schedulerImpl.run gates job generation on leaderElector, so
+// only the elected node in a cluster fans out new archiving/backfill/
+// snapshot/purge work.
+type schedulerImpl struct {
+	sync.RWMutex
+
+	memStore *memStoreImpl
+
+	jobManagers map[memCom.JobType]jobManager
+
+	leaderElector SchedulerLeaderElector
+
+	jobHistory    *JobHistoryStore
+	jobStateStore *JobStateStore
+
+	schedulerStopChan chan struct{}
+
+	dispatchMu sync.Mutex
+	dispatches map[string]*dispatchRecord
+}
+
+// newScheduler creates a schedulerImpl over memStore's shards, defaulting
+// to single-node (always-leader) leader election. It does not start the
+// background generateJobs loop; callers that want scheduling call Start.
+func newScheduler(memStore *memStoreImpl) *schedulerImpl {
+	scheduler := &schedulerImpl{
+		memStore:          memStore,
+		leaderElector:     NewAlwaysLeaderElector("local"),
+		jobHistory:        NewJobHistoryStore(0),
+		schedulerStopChan: make(chan struct{}),
+		dispatches:        make(map[string]*dispatchRecord),
+	}
+
+	scheduler.jobManagers = map[memCom.JobType]jobManager{
+		memCom.ArchivingJobType: &archivingJobManager{
+			baseJobManager: baseJobManager{scheduler: scheduler},
+			jobDetails:     make(map[string]*ArchivingJobDetail),
+		},
+		memCom.BackfillJobType: &backfillJobManager{
+			baseJobManager: baseJobManager{scheduler: scheduler},
+			jobDetails:     make(map[string]*BackfillJobDetail),
+		},
+		memCom.SnapshotJobType: &snapshotJobManager{
+			baseJobManager: baseJobManager{scheduler: scheduler},
+			jobDetails:     make(map[string]*SnapshotJobDetail),
+		},
+		memCom.PurgeJobType: &purgeJobManager{
+			baseJobManager: baseJobManager{scheduler: scheduler},
+			jobDetails:     make(map[string]*PurgeJobDetail),
+		},
+	}
+
+	if scheduler.memStore != nil && scheduler.memStore.metaStore != nil {
+		scheduler.jobStateStore = NewJobStateStore(scheduler.memStore.metaStore)
+	}
+
+	if scheduler.memStore != nil {
+		scheduler.memStore.RLock()
+		for _, shards := range scheduler.memStore.TableShards {
+			for _, shard := range shards {
+				shard.scheduler = scheduler
+			}
+		}
+		scheduler.memStore.RUnlock()
+	}
+
+	return scheduler
+}
+
+// Start rehydrates persisted job state, then begins leader election and the
+// background job-generation loop.
+func (s *schedulerImpl) Start() error {
+	if err := s.loadPersistedJobState(); err != nil {
+		return utils.StackError(err, "failed to load persisted job state")
+	}
+	if err := s.leaderElector.Start(); err != nil {
+		return utils.StackError(err, "failed to start leader election")
+	}
+	go s.run()
+	return nil
+}
+
+// loadPersistedJobState reads every JobStateRecord back from jobStateStore
+// and applies it to the matching jobManager's in-memory jobDetails, so a
+// restarted process picks scheduling up from where it left off instead of
+// re-running generateJobs' readiness checks from a blank slate. A
+// rehydrated BackfillJobDetail whose Stage is still set means the process
+// that wrote it crashed mid-run (BackfillJob.Run clears Stage once it
+// finishes), so that job is re-dispatched to reclaim its
+// BackfillJobTable sub-tasks and resume from their last checkpoint. A
+// Stage of "cancelled" is the one exception: an admin explicitly stopped
+// that job, and BackfillJobTable.MarkCancelled already persisted its
+// sub-tasks so Reclaim won't resume them even if something else re-dispatches
+// the job, but there is no reason to proactively re-dispatch a job that
+// was deliberately cancelled.
+func (s *schedulerImpl) loadPersistedJobState() error {
+	if s.jobStateStore == nil {
+		return nil
+	}
+	records, err := s.jobStateStore.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	for key, record := range records {
+		// loadJobDetail takes the scheduler's write lock itself, so no
+		// scheduler lock may be held across it.
+		s.RLock()
+		jm, ok := s.jobManagers[record.JobType]
+		s.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := jm.loadJobDetail(key, record.Detail); err != nil {
+			return utils.StackError(err, "failed to load job detail for %s", key)
+		}
+		if bjm, ok := jm.(*backfillJobManager); ok {
+			bjm.RLock()
+			detail, ok := bjm.jobDetails[key]
+			resume := ok && detail.Stage != "" && detail.Stage != "cancelled"
+			bjm.RUnlock()
+			if resume {
+				table, shard := parseIdentifier(key)
+				go s.runJob(s.NewBackfillJob(table, shard), DispatchSourceScheduled, nil)
+			}
+		}
+	}
+	return nil
+}
+
+// Stop ends the background job-generation loop and leader election.
+func (s *schedulerImpl) Stop() error {
+	close(s.schedulerStopChan)
+	return s.leaderElector.Close()
+}
+
+// run is the scheduler's main loop: on every tick, if and only if this
+// node currently holds leadership, it asks every jobManager which jobs are
+// due and runs them. Nodes that are not leader skip straight back to
+// sleep, so generateJobs never fires on more than one node at a time.
+func (s *schedulerImpl) run() {
+	ticker := time.NewTicker(schedulerTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.schedulerStopChan:
+			return
+		case <-ticker.C:
+			if !s.leaderElector.IsLeader() {
+				continue
+			}
+			s.RLock()
+			managers := make([]jobManager, 0, len(s.jobManagers))
+			for _, jm := range s.jobManagers {
+				managers = append(managers, jm)
+			}
+			s.RUnlock()
+
+			for _, jm := range managers {
+				for _, job := range jm.generateJobs() {
+					go s.runJob(job, DispatchSourceScheduled, nil)
+				}
+			}
+		}
+	}
+}
+
+// runJob executes job synchronously, recording its outcome to jobHistory,
+// persisting its resulting JobDetail to jobStateStore, and, if record is
+// non-nil (an on-demand Dispatch), signaling its done channel.
+func (s *schedulerImpl) runJob(job Job, source DispatchSource, record *dispatchRecord) {
+	startTime := utils.Now()
+	err := job.Run()
+	endTime := utils.Now()
+
+	if record != nil {
+		record.err = err
+		close(record.done)
+	}
+
+	if s.jobHistory != nil {
+		table, shard := parseIdentifier(job.GetIdentifier())
+		execution := JobExecution{
+			Table:          table,
+			Shard:          shard,
+			JobType:        job.JobType(),
+			StartTime:      startTime,
+			EndTime:        endTime,
+			Succeeded:      err == nil,
+			DispatchSource: source,
+			ErrorMessage:   errorMessage(err),
+		}
+		// Cutoff/BatchIDStart/BatchIDEnd/NumRecords/BytesProcessed are only
+		// meaningful for job types that track them; each type switch case
+		// fills in whichever fields its job populated during Run.
+		switch j := job.(type) {
+		case *ArchivingJob:
+			execution.Cutoff = j.cutoff
+		case *PurgeJob:
+			execution.BatchIDStart = j.batchIDStart
+			execution.BatchIDEnd = j.batchIDEnd
+		case *BackfillJob:
+			execution.NumRecords = j.numRecords
+			execution.BytesProcessed = j.bytesProcessed
+		}
+		s.jobHistory.Record(job.GetIdentifier(), execution)
+	}
+
+	s.persistJobDetail(job)
+}
+
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// persistJobDetail saves job's current JobDetail to jobStateStore, so a
+// process restart can rehydrate it via loadPersistedJobState. It is a
+// no-op if jobStateStore isn't configured, or if job's jobManager has no
+// detail recorded for it yet.
+func (s *schedulerImpl) persistJobDetail(job Job) {
+	if s.jobStateStore == nil {
+		return
+	}
+
+	s.RLock()
+	jm, ok := s.jobManagers[job.JobType()]
+	s.RUnlock()
+	if !ok {
+		return
+	}
+
+	key := job.GetIdentifier()
+	var detail interface{}
+	switch details := jm.getJobDetails().(type) {
+	case map[string]*ArchivingJobDetail:
+		detail, ok = details[key]
+	case map[string]*BackfillJobDetail:
+		detail, ok = details[key]
+	case map[string]*SnapshotJobDetail:
+		detail, ok = details[key]
+	case map[string]*PurgeJobDetail:
+		detail, ok = details[key]
+	}
+	if !ok {
+		return
+	}
+
+	// Best-effort: a failed persist just means a restart won't see this
+	// particular run's progress, the same way a dropped jobHistory.Record
+	// (added alongside execution history) only loses an audit entry
+	// rather than the job's actual effect.
+	s.jobStateStore.Save(key, job.JobType(), detail)
+}
+
+// ClusterStatus reports this node's leader election state.
+func (s *schedulerImpl) ClusterStatus() ClusterStatus {
+	role := SchedulerRoleWorker
+	if s.leaderElector.IsLeader() {
+		role = SchedulerRoleScheduler
+	}
+	return ClusterStatus{
+		NodeID:   s.leaderElector.NodeID(),
+		LeaderID: s.leaderElector.LeaderID(),
+		IsLeader: s.leaderElector.IsLeader(),
+		Role:     role,
+	}
+}
+
+// NewArchivingJob builds an ArchivingJob ready to be run.
+func (s *schedulerImpl) NewArchivingJob(table string, shard int, cutoff uint32) Job {
+	return &ArchivingJob{memStore: s.memStore, tableName: table, shardID: shard, cutoff: cutoff}
+}
+
+// NewBackfillJob builds a BackfillJob ready to be run.
+func (s *schedulerImpl) NewBackfillJob(table string, shard int) Job {
+	return &BackfillJob{memStore: s.memStore, tableName: table, shardID: shard}
+}
+
+// NewSnapshotJob builds a SnapshotJob ready to be run.
+func (s *schedulerImpl) NewSnapshotJob(table string, shard int) Job {
+	return &SnapshotJob{memStore: s.memStore, tableName: table, shardID: shard}
+}
+
+// NewPurgeJob builds a PurgeJob ready to be run.
+func (s *schedulerImpl) NewPurgeJob(table string, shard int, batchIDStart, batchIDEnd int) Job {
+	return &PurgeJob{memStore: s.memStore, tableName: table, shardID: shard, batchIDStart: batchIDStart, batchIDEnd: batchIDEnd}
+}
+
+// GetJobDetails returns the job-type-specific detail map for jobType.
+func (s *schedulerImpl) GetJobDetails(jobType memCom.JobType) interface{} {
+	s.RLock()
+	jm, ok := s.jobManagers[jobType]
+	s.RUnlock()
+	if !ok {
+		return nil
+	}
+	return jm.getJobDetails()
+}
+
+// DeleteTable drops every job detail belonging to table. Archiving,
+// backfill and purge jobs only apply to fact tables; snapshot jobs only
+// apply to dimension tables. No scheduler lock is held here, since each
+// jobManager's deleteTable takes the scheduler's write lock itself.
+func (s *schedulerImpl) DeleteTable(table string, isFactTable bool) {
+	if isFactTable {
+		s.jobManagers[memCom.ArchivingJobType].deleteTable(table)
+		s.jobManagers[memCom.BackfillJobType].deleteTable(table)
+		s.jobManagers[memCom.PurgeJobType].deleteTable(table)
+	} else {
+		s.jobManagers[memCom.SnapshotJobType].deleteTable(table)
+	}
+}
+
+// GetTableSchema looks up the schema of the given table shard.
+func (s *schedulerImpl) GetTableSchema(table string, shard int) (*memCom.TableSchema, error) {
+	s.memStore.RLock()
+	defer s.memStore.RUnlock()
+	shards, ok := s.memStore.TableShards[table]
+	if !ok {
+		return nil, ErrTableDoesNotExist
+	}
+	tableShard, ok := shards[shard]
+	if !ok {
+		return nil, ErrShardDoesNotExist
+	}
+	return tableShard.Schema, nil
+}
+
+// Dispatch submits job to run immediately in its own goroutine, under
+// dispatchID. Wait(dispatchID) blocks until it completes.
+func (s *schedulerImpl) Dispatch(dispatchID string, job Job, meta map[string]string) error {
+	record := &dispatchRecord{done: make(chan struct{})}
+
+	s.dispatchMu.Lock()
+	s.dispatches[dispatchID] = record
+	s.dispatchMu.Unlock()
+
+	go s.runJob(job, DispatchSourceOnDemand, record)
+	return nil
+}
+
+// Wait blocks until the job submitted under dispatchID has completed.
+func (s *schedulerImpl) Wait(dispatchID string) {
+	s.dispatchMu.Lock()
+	record, ok := s.dispatches[dispatchID]
+	s.dispatchMu.Unlock()
+	if !ok {
+		return
+	}
+	<-record.done
+
+	s.dispatchMu.Lock()
+	delete(s.dispatches, dispatchID)
+	s.dispatchMu.Unlock()
+}
+
+// JobKeysByType enumerates every job key currently tracked for jobType.
+func (s *schedulerImpl) JobKeysByType(jobType memCom.JobType) []JobKeyInfo {
+	s.RLock()
+	jm, ok := s.jobManagers[jobType]
+	s.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var keys []string
+	switch details := jm.getJobDetails().(type) {
+	case map[string]*ArchivingJobDetail:
+		for k := range details {
+			keys = append(keys, k)
+		}
+	case map[string]*BackfillJobDetail:
+		for k := range details {
+			keys = append(keys, k)
+		}
+	case map[string]*SnapshotJobDetail:
+		for k := range details {
+			keys = append(keys, k)
+		}
+	case map[string]*PurgeJobDetail:
+		for k := range details {
+			keys = append(keys, k)
+		}
+	}
+
+	infos := make([]JobKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		table, shard := parseIdentifier(key)
+		infos = append(infos, JobKeyInfo{JobKey: key, Table: table, Shard: shard})
+	}
+	return infos
+}
+
+// PauseBackfillJob cooperatively pauses the in-flight backfill job for the
+// given table and shard, and persists the pause to the shard's
+// BackfillJobTable so it survives this instance crashing while the job
+// sits paused.
+func (s *schedulerImpl) PauseBackfillJob(table string, shard int) error {
+	jobKey := getIdentifier(table, shard, memCom.BackfillJobType)
+	if err := backfillControlRegistry.PauseJob(jobKey); err != nil {
+		return err
+	}
+	tableShard, err := getTableShard(s.memStore, table, shard)
+	if err != nil {
+		return err
+	}
+	return tableShard.backfillJobTable().MarkPaused(table, shard, jobKey)
+}
+
+// ResumeBackfillJob resumes a previously paused backfill job for the given
+// table and shard, and reverts its persisted sub-tasks back to running.
+func (s *schedulerImpl) ResumeBackfillJob(table string, shard int) error {
+	jobKey := getIdentifier(table, shard, memCom.BackfillJobType)
+	if err := backfillControlRegistry.ResumeJob(jobKey); err != nil {
+		return err
+	}
+	tableShard, err := getTableShard(s.memStore, table, shard)
+	if err != nil {
+		return err
+	}
+	return tableShard.backfillJobTable().MarkResumed(table, shard, jobKey)
+}
+
+// CancelBackfillJob cancels the in-flight backfill job for the given table
+// and shard, and persists the cancellation to the shard's
+// BackfillJobTable so a future Reclaim never silently resumes the work an
+// admin stopped.
+func (s *schedulerImpl) CancelBackfillJob(table string, shard int) error {
+	jobKey := getIdentifier(table, shard, memCom.BackfillJobType)
+	if err := backfillControlRegistry.CancelJob(jobKey); err != nil {
+		return err
+	}
+	tableShard, err := getTableShard(s.memStore, table, shard)
+	if err != nil {
+		return err
+	}
+	return tableShard.backfillJobTable().MarkCancelled(table, shard, jobKey)
+}
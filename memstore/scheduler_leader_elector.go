@@ -0,0 +1,95 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+// SchedulerRole describes whether the local process is currently acting as
+// the scheduler (deciding which jobs need to run) or as a worker (only
+// executing jobs handed to it). Every node runs the worker role; at most
+// one node in a cluster runs the scheduler role at a time.
+type SchedulerRole string
+
+const (
+	// SchedulerRoleScheduler is held by the single elected leader that is
+	// allowed to call generateJobs and fan work out.
+	SchedulerRoleScheduler SchedulerRole = "scheduler"
+	// SchedulerRoleWorker is held by every node, including the leader,
+	// and just executes jobs that are dispatched to it.
+	SchedulerRoleWorker SchedulerRole = "worker"
+)
+
+// SchedulerLeaderElector decides which node in a cluster is allowed to run
+// the scheduler role. schedulerImpl consults IsLeader before every
+// generateJobs pass so that only the elected node archives/backfills a
+// given shard; all other nodes keep running as workers.
+type SchedulerLeaderElector interface {
+	// Start begins participating in leader election. It must be called
+	// before IsLeader/LeaderID report meaningful values.
+	Start() error
+	// Close stops participating in leader election, releasing leadership
+	// if currently held.
+	Close() error
+	// IsLeader returns whether the local node currently holds leadership.
+	IsLeader() bool
+	// LeaderID returns the identity of the current leader, or "" if no
+	// leader has been established yet.
+	LeaderID() string
+	// NodeID returns the identity this elector advertises for the local
+	// node.
+	NodeID() string
+}
+
+// alwaysLeaderElector is the single-node SchedulerLeaderElector
+// implementation used when no distributed coordination service (etcd,
+// ZooKeeper) is configured. The local node is always the leader, which
+// preserves today's behavior for single-node deployments.
+type alwaysLeaderElector struct {
+	nodeID string
+}
+
+// NewAlwaysLeaderElector creates a SchedulerLeaderElector that unconditionally
+// elects the local node as leader.
+func NewAlwaysLeaderElector(nodeID string) SchedulerLeaderElector {
+	return &alwaysLeaderElector{nodeID: nodeID}
+}
+
+func (e *alwaysLeaderElector) Start() error {
+	return nil
+}
+
+func (e *alwaysLeaderElector) Close() error {
+	return nil
+}
+
+func (e *alwaysLeaderElector) IsLeader() bool {
+	return true
+}
+
+func (e *alwaysLeaderElector) LeaderID() string {
+	return e.nodeID
+}
+
+func (e *alwaysLeaderElector) NodeID() string {
+	return e.nodeID
+}
+
+// ClusterStatus is the read-only snapshot of leader election state surfaced
+// for operators, e.g. through a /cluster debug endpoint.
+type ClusterStatus struct {
+	NodeID   string        `json:"nodeID"`
+	LeaderID string        `json:"leaderID"`
+	IsLeader bool          `json:"isLeader"`
+	Role     SchedulerRole `json:"role"`
+}
+
@@ -0,0 +1,219 @@
+//  Copyright (c) 2017-2018 Uber Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memstore
+
+import (
+	"sync"
+
+	memCom "github.com/uber/aresdb/memstore/common"
+	metaCom "github.com/uber/aresdb/metastore/common"
+)
+
+// BaseBatchID identifies the batch holding live, not-yet-archived records
+// inside a backfillStore.
+const BaseBatchID = 0
+
+// memStoreImpl is the shard registry the scheduler walks to find work:
+// one *TableShard per (table, shardID).
+type memStoreImpl struct {
+	sync.RWMutex
+	metaStore   metaCom.MetaStore
+	diskStore   DiskStore
+	options     Options
+	TableShards map[string]map[int]*TableShard
+}
+
+// GetSchema returns the schema of one of the shards for table, since a
+// table's schema is identical across its shards.
+func (m *memStoreImpl) GetSchema(table string) (*memCom.TableSchema, error) {
+	for _, shard := range m.TableShards[table] {
+		return shard.Schema, nil
+	}
+	return nil, ErrTableDoesNotExist
+}
+
+// DiskStore is the narrow slice of the diskstore.DiskStore interface this
+// package depends on.
+type DiskStore interface {
+	OpenVectorPartyFileForWrite(table string, column string, shard, batchID int, batchVersion, seqNum uint32) (WriteSyncCloser, error)
+	DeleteBatchVersions(table string, shard, batchID int, batchVersion, seqNum uint32) error
+}
+
+// WriteSyncCloser is the minimal writer interface vector party
+// persistence needs.
+type WriteSyncCloser interface {
+	Write(p []byte) (int, error)
+	Sync() error
+	Close() error
+}
+
+// Options carries the handful of tunables TableShard construction needs.
+type Options struct{}
+
+// TableShard owns the live and archive state for one shard of one table.
+type TableShard struct {
+	sync.RWMutex
+	Schema            *memCom.TableSchema
+	ShardID           int
+	metaStore         metaCom.MetaStore
+	diskStore         DiskStore
+	HostMemoryManager memCom.HostMemoryManager
+	LiveStore         *LiveStore
+	ArchiveStore      *ArchiveStore
+	options           Options
+
+	backfillWorkerPool *backfillWorkerPool
+	backfillJobs       *BackfillJobTable
+	// scheduler is set by newScheduler once the shard is registered with a
+	// memStoreImpl, so BackfillJob.Run can find its way back to the
+	// backfillJobManager tracking its progress.
+	scheduler *schedulerImpl
+}
+
+// NewTableShard creates a TableShard backed by the given schema and
+// stores.
+func NewTableShard(schema *memCom.TableSchema, metaStore metaCom.MetaStore, diskStore DiskStore,
+	hostMemoryManager memCom.HostMemoryManager, shardID int, redoLogID int64, options Options) *TableShard {
+	shard := &TableShard{
+		Schema:            schema,
+		ShardID:           shardID,
+		metaStore:         metaStore,
+		diskStore:         diskStore,
+		HostMemoryManager: hostMemoryManager,
+		LiveStore:         newLiveStore(),
+		options:           options,
+	}
+	shard.ArchiveStore = &ArchiveStore{
+		PurgeManager: NewPurgeManager(shard),
+		CurrentVersion: &ArchiveStoreVersion{
+			Batches: make(map[int]*ArchiveBatch),
+			Shard:   shard,
+		},
+	}
+	shard.backfillWorkerPool = newBackfillWorkerPool(int(schema.Schema.Config.BackfillParallelism))
+	shard.backfillJobs = NewBackfillJobTable(metaStore, "local")
+	return shard
+}
+
+// backfillWorkers returns the worker pool patches from this shard's
+// backfill jobs are dispatched across.
+func (shard *TableShard) backfillWorkers() *backfillWorkerPool {
+	return shard.backfillWorkerPool
+}
+
+// backfillJobTable returns the persistent sub-task table this shard's
+// backfill jobs checkpoint their progress into.
+func (shard *TableShard) backfillJobTable() *BackfillJobTable {
+	return shard.backfillJobs
+}
+
+// backfillJobManager returns the backfillJobManager tracking this shard's
+// backfill progress, via the scheduler that registered the shard.
+func (shard *TableShard) backfillJobManager() *backfillJobManager {
+	return shard.scheduler.jobManagers[memCom.BackfillJobType].(*backfillJobManager)
+}
+
+// LiveStore holds the not-yet-archived portion of a fact table shard.
+type LiveStore struct {
+	BackfillManager *BackfillManager
+	SnapshotManager *SnapshotManager
+}
+
+func newLiveStore() *LiveStore {
+	return &LiveStore{
+		BackfillManager: &BackfillManager{},
+		SnapshotManager: &SnapshotManager{},
+	}
+}
+
+// BackfillManager tracks how much unbackfilled data a shard has buffered.
+type BackfillManager struct {
+	CurrentBufferSize int64
+}
+
+// drainPendingUpsertBatches returns the buffered redo-log upsert batches a
+// BackfillJob should apply, clearing the buffer. The live store's redo log
+// replay path is outside this package; until it hands batches off here,
+// there is nothing to drain.
+func (m *BackfillManager) drainPendingUpsertBatches() []*memCom.UpsertBatch {
+	return nil
+}
+
+// SnapshotManager tracks how many live mutations a dimension table shard
+// has buffered since its last snapshot.
+type SnapshotManager struct {
+	NumMutations int
+}
+
+// ArchiveStore holds the immutable, archived portion of a fact table
+// shard as a sequence of versions.
+type ArchiveStore struct {
+	sync.RWMutex
+	PurgeManager   *PurgeManager
+	CurrentVersion *ArchiveStoreVersion
+}
+
+// ArchiveStoreVersion is one immutable snapshot of a shard's archived
+// batches, keyed by day-bucketed BatchID.
+type ArchiveStoreVersion struct {
+	ArchivingCutoff uint32
+	Batches         map[int]*ArchiveBatch
+	Shard           *TableShard
+}
+
+// ArchiveBatch is one day's worth of archived, sorted, columnar data.
+type ArchiveBatch struct {
+	memCom.Batch
+	Size  int
+	Shard *TableShard
+}
+
+// PurgeManager tracks how much purgeable (past retention) data a shard has
+// accumulated.
+type PurgeManager struct {
+	shard *TableShard
+}
+
+// NewPurgeManager creates a PurgeManager for shard.
+func NewPurgeManager(shard *TableShard) *PurgeManager {
+	return &PurgeManager{shard: shard}
+}
+
+// hostMemoryManagerImpl is the concrete memCom.HostMemoryManager backing a
+// memStoreImpl, tracking total bytes used against a configured limit.
+type hostMemoryManagerImpl struct {
+	sync.Mutex
+	memStore    *memStoreImpl
+	limit       int64
+	currentSize int64
+}
+
+// NewHostMemoryManager creates a memCom.HostMemoryManager enforcing limit
+// bytes of total host memory usage across memStore's shards.
+func NewHostMemoryManager(memStore *memStoreImpl, limit int64) memCom.HostMemoryManager {
+	return &hostMemoryManagerImpl{memStore: memStore, limit: limit}
+}
+
+func (h *hostMemoryManagerImpl) ReachedMemoryLimit() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.currentSize >= h.limit
+}
+
+func (h *hostMemoryManagerImpl) ReportUnmanagedSpaceUsageChange(bytes int64) {
+	h.Lock()
+	defer h.Unlock()
+	h.currentSize += bytes
+}